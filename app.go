@@ -1,19 +1,44 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	mathrand "math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"reflect"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"runtime/trace"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"golang.org/x/sync/semaphore"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -26,19 +51,186 @@ var (
 	exitCode = flag.Int("exitCode", 1, "Code which will be used if this service exits after the defined duration.")
 	listen   = flag.String("listen", ":8080", "Where to listen with the health endpoint to.")
 
+	listenCanary = flag.String("listenCanary", "", "If set a second server listens to this address which serves"+
+		" the same endpoints but reports itself as canary.")
+	listenTrace = flag.String("listenTrace", "", "If set a dedicated server listens to this address which serves"+
+		" runtime traces at /debug/trace?seconds=N. Requires -enableDebug.")
+	maxTraceSeconds = flag.Int("maxTraceSeconds", 60, "Maximum duration in seconds of traces requested via /debug/trace?seconds=N.")
+
+	tlsCert = flag.String("tlsCert", "", "Certificate file (PEM) to serve HTTPS instead of HTTP. Requires -tlsKey.")
+	tlsKey  = flag.String("tlsKey", "", "Private key file (PEM) to serve HTTPS instead of HTTP. Requires -tlsCert.")
+
+	tlsHandshakeDelay = flag.Duration("tlsHandshakeDelay", 0, "If set (and TLS is enabled) every TLS handshake is delayed by this duration;"+
+		" the resulting handshake duration is reported via X-TLS-Handshake-Ms.")
+
+	connectionHeader = flag.String("connectionHeader", "", "If set (keep-alive or close) every HTTP/1.x response contains this Connection header."+
+		" close also closes the connection after each response.")
+
+	hstsMaxAge            = flag.Duration("hstsMaxAge", 0, "If set HTTPS responses contain a Strict-Transport-Security header with this max-age. 0 == disabled.")
+	hstsIncludeSubdomains = flag.Bool("hstsIncludeSubdomains", false, "Adds includeSubDomains to the Strict-Transport-Security header.")
+	hstsPreload           = flag.Bool("hstsPreload", false, "Adds preload to the Strict-Transport-Security header.")
+
+	proxyProtocol = flag.Bool("proxyProtocol", false, "Expects every connection to start with a PROXY protocol v1 header"+
+		" (as sent by HAProxy or some load balancers) which contains the real client address.")
+
+	shutdownTimeout = flag.Duration("shutdownTimeout", 10*time.Second, "Maximum duration to wait for running"+
+		" requests to finish after a termination signal was received.")
+	kubernetesGraceful = flag.Bool("kubernetesGraceful", false, "If enabled a SIGTERM first reports the service as not ready"+
+		" and waits -endpointRemovalDelay for it to be removed from the Kubernetes Endpoints before draining the requests.")
+	endpointRemovalDelay = flag.Duration("endpointRemovalDelay", 5*time.Second, "Duration to wait with -kubernetesGraceful"+
+		" after the service was reported as not ready before draining the requests.")
+
+	jsonIndent = flag.Bool("jsonIndent", true, "Whether JSON responses are indented by default. Clients can override this via ?json=compact or ?json=pretty.")
+
+	maxDelay = flag.Duration("maxDelay", 10*time.Second, "Maximum delay a client is allowed to request.")
+
+	maxConcurrent = flag.Int("maxConcurrent", 0, "Maximum number of requests served concurrently."+
+		" Requests above this limit are rejected with 429. 0 == unlimited.")
+
+	workerPool = flag.Int("workerPool", 0, "Number of workers which serve the echo responses."+
+		" Requests waiting longer than -workerQueueTimeout for a worker are rejected with 503. 0 == disabled.")
+	workerQueueTimeout = flag.Duration("workerQueueTimeout", 5*time.Second, "Maximum duration requests wait for a free worker of -workerPool.")
+
+	enableAdmin       = flag.Bool("enableAdmin", false, "Enables the administrative endpoints like /logs/requests.")
+	latencyWindowSize = flag.Int("latencyWindowSize", 10000, "Number of latest request durations the latency percentiles of /stats are based on.")
+	requestLogSize    = flag.Int("requestLogSize", 100, "Number of latest requests kept for /logs/requests.")
+
+	enableChaos = flag.Bool("enableChaos", false, "Enables the /simulate/... endpoints which disturb this service on purpose.")
+	maxBodySize = flag.Int64("maxBodySize", 10*1024*1024, "Maximum number of bytes read from a request body.")
+
+	warmupRequests = flag.Int("warmupRequests", 0, "Number of requests which are served with a reduced response"+
+		" before this service counts as warmed up.")
+
+	allowCustomStatusMessage = flag.Bool("allowCustomStatusMessage", false, "Allows clients to define the reason phrase"+
+		" of the response status line via ?statusMessage=. Only supported for HTTP/1.x.")
+
+	allowEnvEcho = flag.Bool("allowEnvEcho", false, "Allows clients to request environment variables via ?includeEnv=<prefix>.")
+	maskEnvVars  = flag.String("maskEnvVars", "*PASSWORD*,*SECRET*,*TOKEN*,*KEY*", "Comma separated patterns of"+
+		" environment variable names whose values are masked if echoed.")
+
+	enableLargeBody = flag.Bool("enableLargeBody", false, "Allows clients to request large responses via ?body=large&mb=N.")
+	maxLargeBodyMB  = flag.Int("maxLargeBodyMB", 10, "Maximum size in megabytes of responses requested via ?body=large.")
+
+	enableOAuth2Mock      = flag.Bool("enableOAuth2Mock", false, "Enables a mocked OAuth2 token endpoint at /oauth2/token.")
+	oauth2FailProbability = flag.Float64("oauth2FailProbability", 0, "Probability (0.0 - 1.0) that /oauth2/token fails with a server error.")
+
+	simulateCDN    = flag.Bool("simulateCDN", false, "If enabled responses are cached by path like a CDN would do, reported via X-Cache-Status.")
+	cdnCacheMaxAge = flag.Int("cdnCacheMaxAge", 60, "Seconds responses are cached if -simulateCDN is enabled.")
+
+	enableJSONP = flag.Bool("enableJSONP", false, "Allows clients to request JSONP responses via ?callback=<function>.")
+
+	enableDebug = flag.Bool("enableDebug", false, "Enables debugging features like ?includeStack=true.")
+
+	maxSyntheticHeadersSize = flag.Int("maxSyntheticHeadersSize", 8*1024, "Maximum total size in bytes of the headers requested via ?responseHeaders=N.")
+
+	enableDNSSimulation = flag.Bool("enableDNSSimulation", false, "Enables the /dns/self and /dns/service endpoints.")
+	dnsLookupTimeout    = flag.Duration("dnsLookupTimeout", 2*time.Second, "Maximum duration of DNS lookups done by /dns/... endpoints.")
+
+	allowContentDisposition = flag.Bool("allowContentDisposition", false, "Allows clients to request a Content-Disposition header via ?contentDisposition=attachment&filename=<name>.")
+
+	enableMock     = flag.Bool("enableMock", false, "Enables the /mock/<schemaName> endpoint which returns random instances of JSON schemas.")
+	mockSchemasDir = flag.String("mockSchemasDir", "schemas", "Directory which contains the <schemaName>.json schema files for /mock/<schemaName>.")
+
+	allowSetCookieParam = flag.Bool("allowSetCookieParam", false, "Allows clients to request cookies via ?set-cookie=<name>=<value>.")
+
+	allowMutation = flag.Bool("allowMutation", false, "Allows clients to mutate the echoed request headers via ?mutateHeader=<name>:<old value>:<new value>.")
+
+	xFrameOptions = flag.String("xFrameOptions", "", "If set (DENY or SAMEORIGIN) echo responses contain this X-Frame-Options header.")
+
+	stickySession = flag.Bool("stickySession", false, "If enabled every client receives a "+sessionCookieName+
+		" cookie which identifies its session in following responses.")
+
 	ready = new(atomic.Value)
+	// readyMutex guards changes of ready and terminating.
+	readyMutex  sync.Mutex
+	terminating bool
+
+	// healthWatchers holds a chan bool for every /healthz/watch subscription.
+	healthWatchers = new(sync.Map)
+	// tlsHandshakes holds a *tlsHandshake for every connection by its remote address.
+	tlsHandshakes = new(sync.Map)
+	shuttingDown  = make(chan struct{})
+
+	jsonpCallbackPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	filenamePattern      = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+	server       *http.Server
+	canaryServer *http.Server
+	traceServer  *http.Server
+
+	// requests and latencies are recreated by main once the flags are parsed.
+	requests  = newRequestLog(*requestLogSize)
+	latencies = newLatencyTracker(*latencyWindowSize)
+
+	panicCount       int64
+	lastPanicMutex   sync.Mutex
+	lastPanicTime    time.Time
+	lastPanicMessage string
+
+	concurrencyLimit *semaphore.Weighted
+	workers          *semaphore.Weighted
+	workersBusy      int64
+	requestDurations = new(durationWindow)
+
+	partition = new(partitionGate)
+
+	cpuThrottleMutex   sync.Mutex
+	currentCPUThrottle *cpuThrottle
+
+	cdnCacheMutex sync.Mutex
+	cdnCache      = make(map[cdnCacheKey]cdnCacheEntry)
+
+	servedRequests int64
+
+	baseDocumentMutex sync.RWMutex
+	baseDocument      = json.RawMessage(`{}`)
 )
 
+const sessionCookieName = "KUBOR_SESSION"
+
 func init() {
 	ready.Store(false)
+	mathrand.Seed(time.Now().UnixNano())
 }
 
 func main() {
 	log.Printf("kubor-demo1 (branch=%s, revision=%s) is starting...", branch, revision)
 	flag.Parse()
 
+	requests = newRequestLog(*requestLogSize)
+	latencies = newLatencyTracker(*latencyWindowSize)
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("Both -tlsCert and -tlsKey are required to enable TLS.")
+	}
+	if *connectionHeader != "" && *connectionHeader != "keep-alive" && *connectionHeader != "close" {
+		log.Fatalf("Illegal -connectionHeader %q; expected keep-alive, close or nothing.", *connectionHeader)
+	}
+	if *xFrameOptions != "" && *xFrameOptions != "DENY" && *xFrameOptions != "SAMEORIGIN" {
+		log.Fatalf("Illegal -xFrameOptions %q; expected DENY, SAMEORIGIN or nothing.", *xFrameOptions)
+	}
+	if *tlsHandshakeDelay > 0 && !isTLSEnabled() {
+		log.Printf("WARN -tlsHandshakeDelay is set but TLS is not enabled; no handshake will be delayed.")
+	}
+	if *hstsMaxAge > 0 && !isTLSEnabled() {
+		log.Printf("WARN -hstsMaxAge is set but TLS is not enabled; no Strict-Transport-Security header will be sent.")
+	}
+	if *maxConcurrent > 0 {
+		concurrencyLimit = semaphore.NewWeighted(int64(*maxConcurrent))
+	}
+	if *workerPool > 0 {
+		workers = semaphore.NewWeighted(int64(*workerPool))
+	}
+	server = newServer(*listen)
+	go runServer(server)
+	if *listenCanary != "" {
+		canaryServer = newServer(*listenCanary)
+		go runServer(canaryServer)
+	}
+	if *listenTrace != "" {
+		traceServer = newTraceServer(*listenTrace)
+		go runTraceServer(traceServer)
+	}
 	registerGracefulShutdown()
-	go runServer()
 	waitToBeReady()
 	justRun()
 	log.Printf("Good bye...")
@@ -46,21 +238,201 @@ func main() {
 }
 
 func registerGracefulShutdown() {
-	var gracefulStop = make(chan os.Signal)
+	var gracefulStop = make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
 	go func() {
-		sig := <-gracefulStop
-		log.Printf("Received %v signal. Bye!", sig)
+		shutdownGracefully(<-gracefulStop)
+		log.Printf("Bye!")
 		os.Exit(0)
 	}()
 }
 
-func runServer() {
-	log.Printf("Listen to %s...", *listen)
-	if err := http.ListenAndServe(*listen, http.HandlerFunc(handler)); err != nil {
-		log.Fatalf("Cannot listen to %s: %v", *listen, err)
+// shutdownGracefully shuts down all servers. With -kubernetesGraceful a
+// SIGTERM first reports this service as not ready and waits for the removal
+// from the endpoints before draining.
+func shutdownGracefully(sig os.Signal) {
+	log.Printf("Received %v signal. Shutting down...", sig)
+	if *kubernetesGraceful && sig == syscall.SIGTERM {
+		terminate()
+		log.Printf("Reported as not ready. Waiting %v for the removal from the endpoints...", *endpointRemovalDelay)
+		time.Sleep(*endpointRemovalDelay)
+		log.Printf("Draining requests for at most %v...", *shutdownTimeout)
+	}
+	shutdownServers()
+}
+
+// shutdownServers drains all running servers in parallel but waits at most
+// -shutdownTimeout for running requests to finish.
+func shutdownServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	close(shuttingDown)
+	wg := new(sync.WaitGroup)
+	for _, s := range []*http.Server{server, canaryServer, traceServer} {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("ERROR shutting down server at %s: %v", s.Addr, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func newServer(addr string) *http.Server {
+	result := &http.Server{
+		Addr:    addr,
+		Handler: withRequestLog(withRecovery(withHSTS(withConnectionHeader(withDecompression(handler))))),
+	}
+	if *connectionHeader == "close" {
+		result.SetKeepAlivesEnabled(false)
+	}
+	if *tlsHandshakeDelay > 0 && isTLSEnabled() {
+		result.TLSConfig = &tls.Config{GetConfigForClient: delayTLSHandshake}
+		result.ConnState = trackTLSHandshake
+	}
+	return result
+}
+
+// tlsHandshake is the handshake of a connection; duration is only valid
+// after done was closed.
+type tlsHandshake struct {
+	done     chan struct{}
+	duration time.Duration
+}
+
+func delayTLSHandshake(*tls.ClientHelloInfo) (*tls.Config, error) {
+	time.Sleep(*tlsHandshakeDelay)
+	return nil, nil
+}
+
+// trackTLSHandshake records the handshake duration of every new connection
+// in tlsHandshakes. The entry is stored here, because the server calls this
+// for StateNew before it starts serving the connection; only the handshake
+// itself runs in the background. Handshake is safe to call concurrently to
+// the one of the server; both return once it is completed.
+func trackTLSHandshake(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			return
+		}
+		start := time.Now()
+		handshake := &tlsHandshake{done: make(chan struct{})}
+		key := conn.RemoteAddr().String()
+		tlsHandshakes.Store(key, handshake)
+		go func() {
+			defer close(handshake.done)
+			if err := tlsConn.Handshake(); err != nil {
+				tlsHandshakes.Delete(key)
+				return
+			}
+			handshake.duration = time.Since(start)
+		}()
+	case http.StateClosed, http.StateHijacked:
+		tlsHandshakes.Delete(conn.RemoteAddr().String())
+	}
+}
+
+// tlsHandshakeDurationOf returns the handshake duration of the connection of
+// the given request if it was tracked.
+func tlsHandshakeDurationOf(req *http.Request) (time.Duration, bool) {
+	plain, ok := tlsHandshakes.Load(req.RemoteAddr)
+	if !ok {
+		return 0, false
+	}
+	handshake := plain.(*tlsHandshake)
+	<-handshake.done
+	return handshake.duration, true
+}
+
+func runServer(s *http.Server) {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		log.Fatalf("Cannot listen to %s: %v", s.Addr, err)
+	}
+	if *proxyProtocol {
+		l = &proxyProtocolListener{Listener: l}
+	}
+	if isTLSEnabled() {
+		log.Printf("Listen to %s (TLS)...", s.Addr)
+		err = s.ServeTLS(l, *tlsCert, *tlsKey)
+	} else {
+		log.Printf("Listen to %s...", s.Addr)
+		err = s.Serve(l)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Cannot listen to %s: %v", s.Addr, err)
+	}
+}
+
+func newTraceServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/trace", handleDebugTrace)
+	return &http.Server{
+		Addr:    addr,
+		Handler: withRecovery(mux.ServeHTTP),
+	}
+}
+
+func runTraceServer(s *http.Server) {
+	log.Printf("Listen to %s (trace)...", s.Addr)
+	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Cannot listen to %s: %v", s.Addr, err)
+	}
+}
+
+// handleDebugTrace records a runtime trace for ?seconds=N (default 5) and
+// responds with it.
+func handleDebugTrace(resp http.ResponseWriter, req *http.Request) {
+	if !*enableDebug {
+		notEnabled(resp, req, "enableDebug")
+		return
+	}
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	seconds := 5
+	if plain := req.URL.Query().Get("seconds"); plain != "" {
+		var err error
+		if seconds, err = strconv.Atoi(plain); err != nil || seconds <= 0 {
+			writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Illegal seconds: %s", plain))
+			return
+		}
+	}
+	if seconds > *maxTraceSeconds {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Illegal seconds: %d exceeds the maximum of %d", seconds, *maxTraceSeconds))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(resp); err != nil {
+		resp.Header().Del("Content-Disposition")
+		writeError(resp, req, http.StatusConflict, "trace_in_progress", fmt.Sprintf("Cannot start trace: %v", err))
+		return
 	}
+	sleep(req.Context(), time.Duration(seconds)*time.Second)
+	trace.Stop()
+	if flusher, ok := resp.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func isTLSEnabled() bool {
+	return *tlsCert != "" && *tlsKey != ""
+}
+
+// isCanary reports whether the request was received by the -listenCanary server.
+func isCanary(req *http.Request) bool {
+	s, _ := req.Context().Value(http.ServerContextKey).(*http.Server)
+	return canaryServer != nil && s == canaryServer
 }
 
 func waitToBeReady() {
@@ -68,7 +440,97 @@ func waitToBeReady() {
 		log.Printf("Waiting for %v to be ready...", *readyAfter)
 		time.Sleep(*readyAfter)
 	}
-	ready.Store(true)
+	waitForServerToListen(*listen)
+	setReady(true)
+}
+
+const (
+	selfTestAttempts = 10
+	selfTestInterval = 100 * time.Millisecond
+)
+
+// waitForServerToListen calls the own /healthz endpoint until the server is
+// accepting connections, so the ready state is never reported before that.
+// Both 200 and 503 count as success; no one is ready at this point.
+func waitForServerToListen(addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Printf("WARN cannot determine port of %s for the self-test, skipping it: %v", addr, err)
+		return
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	scheme := "http"
+	transport := &http.Transport{}
+	if isTLSEnabled() {
+		// Only reachability matters, the certificate does not need to match localhost.
+		scheme = "https"
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if *proxyProtocol {
+		transport.DialContext = dialWithProxyProtocol
+	}
+	client := &http.Client{Timeout: time.Second, Transport: transport}
+	url := scheme + "://" + net.JoinHostPort(host, port) + "/healthz"
+	for attempt := 1; attempt <= selfTestAttempts; attempt++ {
+		resp, err := client.Get(url)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusServiceUnavailable {
+				return
+			}
+			err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		log.Printf("Self-test %d/%d of %s failed: %v", attempt, selfTestAttempts, url, err)
+		time.Sleep(selfTestInterval)
+	}
+	log.Printf("WARN server does not respond at %s after %d attempts; reporting ready anyway.", url, selfTestAttempts)
+}
+
+// terminate reports this service as not ready for good; it can never become
+// ready again, even if -readyAfter is still running.
+func terminate() {
+	readyMutex.Lock()
+	terminating = true
+	readyMutex.Unlock()
+	setReady(false)
+}
+
+// setReady changes the ready state and notifies all /healthz/watch subscribers
+// if it actually changed. Once terminating it stays not ready.
+func setReady(v bool) {
+	readyMutex.Lock()
+	defer readyMutex.Unlock()
+	if v && terminating {
+		log.Printf("Shutdown is in progress; not reporting ready.")
+		return
+	}
+	if old := ready.Load().(bool); old == v {
+		return
+	}
+	ready.Store(v)
+	healthWatchers.Range(func(key, _ interface{}) bool {
+		notifyHealthWatcher(key.(chan bool), v)
+		return true
+	})
+}
+
+// notifyHealthWatcher sends the state to the 1-slot channel of a subscriber. A
+// state the subscriber did not receive yet is replaced, so a slow subscriber
+// skips intermediate states but always ends up with the latest one.
+func notifyHealthWatcher(changes chan bool, v bool) {
+	for {
+		select {
+		case changes <- v:
+			return
+		default:
+		}
+		select {
+		case <-changes:
+		default:
+		}
+	}
 }
 
 func justRun() {
@@ -87,26 +549,380 @@ func blockForEver() {
 	wg.Wait()
 }
 
+// withRequestLog records every served request for /logs/requests and the
+// latency percentiles of /stats.
+func withRequestLog(delegate http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: resp}
+		defer func() {
+			duration := time.Since(start)
+			latencies.Record(duration)
+			requests.add(requestLogEntry{
+				Timestamp:  start,
+				Method:     req.Method,
+				Path:       req.URL.Path,
+				Status:     recorder.statusCode,
+				DurationMs: int64(duration / time.Millisecond),
+				RemoteIP:   remoteIPOf(req),
+				RequestID:  requestIDOf(req),
+			})
+		}()
+		delegate(recorder, req)
+	}
+}
+
+// withRecovery ensures that a panicking handler does not bring down the whole
+// service. Each recovered panic is logged and counted for /stats.
+func withRecovery(delegate http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+			atomic.AddInt64(&panicCount, 1)
+			lastPanicMutex.Lock()
+			lastPanicTime = time.Now()
+			lastPanicMessage = fmt.Sprint(r)
+			lastPanicMutex.Unlock()
+			log.Printf("ERROR recovered panic while serving %s to %v: %v\n%s", req.URL.Path, req.RemoteAddr, r, debug.Stack())
+			internalServerError(resp, req)
+		}()
+		delegate(resp, req)
+	}
+}
+
+// withHSTS adds the Strict-Transport-Security header to responses served via
+// TLS if -hstsMaxAge is set.
+func withHSTS(delegate http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if *hstsMaxAge > 0 && req.TLS != nil {
+			resp.Header().Set("Strict-Transport-Security", hstsHeaderValue())
+		}
+		delegate(resp, req)
+	}
+}
+
+func hstsHeaderValue() string {
+	result := fmt.Sprintf("max-age=%d", int64(*hstsMaxAge/time.Second))
+	if *hstsIncludeSubdomains {
+		result += "; includeSubDomains"
+	}
+	if *hstsPreload {
+		result += "; preload"
+	}
+	return result
+}
+
+// withConnectionHeader sets the Connection header configured by
+// -connectionHeader. HTTP/2 does not know this header, so it is only set for
+// HTTP/1.x.
+func withConnectionHeader(delegate http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if *connectionHeader != "" && req.ProtoMajor == 1 {
+			resp.Header().Set("Connection", *connectionHeader)
+		}
+		delegate(resp, req)
+	}
+}
+
+// withDecompression transparently decompresses gzip or deflate encoded request
+// bodies, so handlers always see the plain body.
+func withDecompression(delegate http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		var decompressed io.ReadCloser
+		switch encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))); encoding {
+		case "gzip":
+			r, err := gzip.NewReader(req.Body)
+			if err != nil {
+				writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Cannot decompress %s request body: %v", encoding, err))
+				return
+			}
+			decompressed = r
+		case "deflate":
+			// HTTP deflate is zlib wrapped (RFC 9110, section 8.4.1.2).
+			r, err := zlib.NewReader(req.Body)
+			if err != nil {
+				writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Cannot decompress %s request body: %v", encoding, err))
+				return
+			}
+			decompressed = r
+		default:
+			delegate(resp, req)
+			return
+		}
+		defer decompressed.Close()
+		req.Body = decompressed
+		req.ContentLength = -1
+		req.Header.Del("Content-Encoding")
+		req.Header.Del("Content-Length")
+		delegate(resp, req)
+	}
+}
+
 func handler(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/simulate/partition" {
+		// Blocks as long as a simulated partition is in progress. Requests which
+		// are already in progress (like /healthz/watch streams) are not affected.
+		partition.wait(req.Context())
+		if req.Context().Err() != nil {
+			return
+		}
+	}
 	switch req.URL.Path {
+	case "/simulate/partition":
+		handleSimulatePartition(resp, req)
+	case "/simulate/slow-read":
+		handleSimulateSlowRead(resp, req)
+	case "/simulate/cpu-limit":
+		handleSimulateCPULimit(resp, req)
+	case "/simulate/cpu-limit/stop":
+		handleSimulateCPULimitStop(resp, req)
 	case "/healthz":
 		handleHealth(resp, req)
+	case "/healthz/watch":
+		handleHealthWatch(resp, req)
+	case "/healthz/verbose":
+		handleHealthVerbose(resp, req)
+	case "/stats":
+		handleStats(resp, req)
+	case "/stats/panics":
+		handleStatsPanics(resp, req)
+	case "/logs/requests":
+		handleLogsRequests(resp, req)
+	case "/oauth2/token":
+		handleOAuth2Token(resp, req)
+	case "/patch/base":
+		handlePatchBase(resp, req)
+	case "/dns/self":
+		handleDNSSelf(resp, req)
+	case "/dns/service":
+		handleDNSService(resp, req)
+	case "/cdn/purge":
+		handleCDNPurge(resp, req)
 	default:
-		handleEveryThingElse(resp, req)
+		if strings.HasPrefix(req.URL.Path, "/mock/") {
+			handleMock(resp, req)
+		} else {
+			limitConcurrency(resp, req, handleCDN)
+		}
+	}
+}
+
+// limitConcurrency rejects the request with 429 if already -maxConcurrent
+// requests are in progress. Retry-After is estimated based on the average
+// duration of the recently served requests.
+func limitConcurrency(resp http.ResponseWriter, req *http.Request, delegate http.HandlerFunc) {
+	if concurrencyLimit == nil {
+		delegate(resp, req)
+		return
+	}
+	if !concurrencyLimit.TryAcquire(1) {
+		retryAfter := int(math.Ceil(requestDurations.average().Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		resp.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(resp, req, http.StatusTooManyRequests, "too_many_requests", http.StatusText(http.StatusTooManyRequests))
+		return
+	}
+	defer concurrencyLimit.Release(1)
+	start := time.Now()
+	defer func() {
+		requestDurations.record(time.Since(start))
+	}()
+	delegate(resp, req)
+}
+
+// useWorker lets the delegate serve the request once one of the -workerPool
+// workers is free. Requests waiting longer than -workerQueueTimeout are
+// rejected with 503.
+func useWorker(resp http.ResponseWriter, req *http.Request, delegate http.HandlerFunc) {
+	if workers == nil {
+		delegate(resp, req)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), *workerQueueTimeout)
+	defer cancel()
+	if err := workers.Acquire(ctx, 1); err != nil {
+		log.Printf("WARN worker pool of %d workers is saturated; rejecting request of %v after %v.", *workerPool, req.RemoteAddr, *workerQueueTimeout)
+		writeError(resp, req, http.StatusServiceUnavailable, "workers_exhausted", "No worker available.")
+		return
+	}
+	atomic.AddInt64(&workersBusy, 1)
+	defer func() {
+		atomic.AddInt64(&workersBusy, -1)
+		workers.Release(1)
+	}()
+	delegate(resp, req)
+}
+
+func methodNotAllowed(resp http.ResponseWriter, req *http.Request) {
+	writeError(resp, req, http.StatusMethodNotAllowed, "method_not_allowed", http.StatusText(http.StatusMethodNotAllowed))
+}
+
+func internalServerError(resp http.ResponseWriter, req *http.Request) {
+	writeError(resp, req, http.StatusInternalServerError, "internal_error", http.StatusText(http.StatusInternalServerError))
+}
+
+func notEnabled(resp http.ResponseWriter, req *http.Request, flagName string) {
+	writeError(resp, req, http.StatusNotFound, "not_enabled", fmt.Sprintf("Not enabled. Start with -%s to enable.", flagName))
+}
+
+func parameterNotEnabled(resp http.ResponseWriter, req *http.Request, parameter string, flagName string) {
+	writeError(resp, req, http.StatusBadRequest, "not_enabled", fmt.Sprintf("Parameter %s is not enabled. Start with -%s to enable.", parameter, flagName))
+}
+
+// handleSimulatePartition lets all other requests block for ?durationMs=N as
+// if this service were not reachable.
+func handleSimulatePartition(resp http.ResponseWriter, req *http.Request) {
+	if !*enableChaos {
+		notEnabled(resp, req, "enableChaos")
+		return
+	}
+	if req.Method != "POST" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	duration, err := delayParameter(req, "durationMs")
+	if err == nil && duration <= 0 {
+		err = fmt.Errorf("durationMs required")
+	}
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	log.Printf("Simulating partition for %v...", duration)
+	partition.begin(duration)
+	writeJSON(resp, req, http.StatusAccepted, partitionBody{
+		DurationMs: int(duration / time.Millisecond),
+	})
+}
+
+// handleSimulateSlowRead reads the request body byte by byte with a delay of
+// ?byteDelayMs=N (default 10) between each byte to provoke write timeouts
+// at the client.
+func handleSimulateSlowRead(resp http.ResponseWriter, req *http.Request) {
+	if !*enableChaos {
+		notEnabled(resp, req, "enableChaos")
+		return
+	}
+	if req.Method != "POST" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	byteDelay := 10 * time.Millisecond
+	if req.URL.Query().Get("byteDelayMs") != "" {
+		var err error
+		if byteDelay, err = delayParameter(req, "byteDelayMs"); err != nil {
+			writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+	start := time.Now()
+	body := io.LimitReader(req.Body, *maxBodySize)
+	b := make([]byte, 1)
+	var bytesRead int64
+	for {
+		n, err := body.Read(b)
+		bytesRead += int64(n)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Stopped slow read of %v after %d bytes: %v", req.RemoteAddr, bytesRead, err)
+			}
+			break
+		}
+		sleep(req.Context(), byteDelay)
+		if req.Context().Err() != nil {
+			log.Printf("Stopped slow read of %v after %d bytes: %v", req.RemoteAddr, bytesRead, req.Context().Err())
+			break
+		}
+	}
+	writeJSON(resp, req, http.StatusOK, slowReadBody{
+		BytesRead:  bytesRead,
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+	})
+}
+
+// handleSimulateCPULimit simulates a CPU limit of ?cpuPercent=N as Kubernetes
+// enforces it: within every window the service may only run N percent of the
+// time. A dedicated goroutine burns the CPU during that part, while echo
+// requests have to wait for the next window if they arrive in the throttled
+// part.
+func handleSimulateCPULimit(resp http.ResponseWriter, req *http.Request) {
+	if !*enableChaos {
+		notEnabled(resp, req, "enableChaos")
+		return
+	}
+	if req.Method != "POST" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	plainPercent := req.URL.Query().Get("cpuPercent")
+	percent, err := strconv.Atoi(plainPercent)
+	if err != nil || percent < 1 || percent > 100 {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Illegal cpuPercent: %s; expected 1-100", plainPercent))
+		return
+	}
+	throttle := &cpuThrottle{
+		percent: percent,
+		start:   time.Now(),
+		stop:    make(chan struct{}),
+	}
+	cpuThrottleMutex.Lock()
+	if currentCPUThrottle != nil {
+		close(currentCPUThrottle.stop)
+	}
+	currentCPUThrottle = throttle
+	cpuThrottleMutex.Unlock()
+	go throttle.burn()
+	log.Printf("Simulating CPU limit of %d%%...", percent)
+	writeJSON(resp, req, http.StatusAccepted, cpuLimitBody{CPUPercent: percent})
+}
+
+func handleSimulateCPULimitStop(resp http.ResponseWriter, req *http.Request) {
+	if !*enableChaos {
+		notEnabled(resp, req, "enableChaos")
+		return
+	}
+	if req.Method != "POST" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	cpuThrottleMutex.Lock()
+	if currentCPUThrottle != nil {
+		close(currentCPUThrottle.stop)
+		currentCPUThrottle = nil
+		log.Printf("Simulated CPU limit removed.")
 	}
+	cpuThrottleMutex.Unlock()
+	resp.WriteHeader(http.StatusNoContent)
 }
 
-func methodNotAllowed(resp http.ResponseWriter) {
-	http.Error(resp, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+// waitForCPU blocks while the current window of a simulated CPU limit is in
+// its throttled part.
+func waitForCPU(ctx context.Context) {
+	cpuThrottleMutex.Lock()
+	throttle := currentCPUThrottle
+	cpuThrottleMutex.Unlock()
+	if throttle == nil {
+		return
+	}
+	sleep(ctx, throttle.remainingThrottling(time.Now()))
 }
 
 func handleHealth(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
-		methodNotAllowed(resp)
+	if req.Method != "GET" && req.Method != "HEAD" {
+		methodNotAllowed(resp, req)
 		return
 	}
 	r := ready.Load().(bool)
 	var v string
+	resp.Header().Set("Content-Type", "text/plain")
 	if r {
 		resp.WriteHeader(http.StatusOK)
 		v = "OK"
@@ -114,58 +930,1921 @@ func handleHealth(resp http.ResponseWriter, req *http.Request) {
 		resp.WriteHeader(http.StatusServiceUnavailable)
 		v = "NOT_READY"
 	}
-	resp.Header().Set("Content-Type", "text/plain")
+	if req.Method == "HEAD" {
+		return
+	}
 	if _, err := fmt.Fprintf(resp, `%s`, v); err != nil {
 		log.Printf("ERROR writing response (%s) to %v: %v", v, req.RemoteAddr, err)
 	}
 }
 
-func handleEveryThingElse(resp http.ResponseWriter, req *http.Request) {
-	resp.Header().Set("Content-Type", "application/json")
-	plainStatusCode := req.URL.Query().Get("statusCode")
-	if statusCode, err := strconv.Atoi(plainStatusCode); err == nil && statusCode >= 100 && statusCode < 1000 {
-		resp.WriteHeader(statusCode)
+// handleHealthVerbose reports the health state together with everything of
+// /stats in one response for humans triaging an incident. It is more expensive
+// than /healthz and should not be used as Kubernetes probe.
+func handleHealthVerbose(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
 	}
-	enc := json.NewEncoder(resp)
-	enc.SetIndent("", "  ")
-	body := responseBodyFor(req)
-	if err := enc.Encode(body); err != nil {
-		log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+	body := verboseHealthBody{
+		Stats: currentStats(),
 	}
+	statusCode := http.StatusOK
+	body.Health = healthBodyOf(ready.Load().(bool))
+	if !body.Health.Ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJSON(resp, req, statusCode, body)
 }
 
-func responseBodyFor(req *http.Request) (result responseBody) {
-	result.Runtime.Branch = branch
-	result.Runtime.Revision = revision
-	result.Runtime.Platform = runtime.GOOS + "-" + runtime.GOARCH
+// handleHealthWatch streams the current health state and every change of it
+// as server-sent events.
+func handleHealthWatch(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	if !strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		writeError(resp, req, http.StatusNotAcceptable, "not_acceptable", "Only text/event-stream is supported.")
+		return
+	}
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		writeError(resp, req, http.StatusInternalServerError, "internal_error", "Streaming is not supported by this connection.")
+		return
+	}
+	changes := make(chan bool, 1)
+	healthWatchers.Store(changes, true)
+	defer healthWatchers.Delete(changes)
 
-	result.Request.Proto = req.Proto
-	result.Request.Host = req.Host
-	result.Request.Method = req.Method
-	result.Request.RequestURI = req.RequestURI
-	result.Request.Headers = req.Header
-	result.Request.Form = req.Form
-	result.Request.PostForm = req.PostForm
-	return
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	r := ready.Load().(bool)
+	for {
+		plain, err := json.Marshal(healthBodyOf(r))
+		if err != nil {
+			log.Printf("ERROR encoding health event for %v: %v", req.RemoteAddr, err)
+			return
+		}
+		if _, err := fmt.Fprintf(resp, "event: health\ndata: %s\n\n", plain); err != nil {
+			log.Printf("ERROR writing health event to %v: %v", req.RemoteAddr, err)
+			return
+		}
+		flusher.Flush()
+		select {
+		case r = <-changes:
+		case <-req.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		}
+	}
 }
 
-type responseBody struct {
-	Runtime runtimeBody `json:"runtime"`
-	Request requestBody `json:"request"`
+func healthBodyOf(r bool) healthBody {
+	if r {
+		return healthBody{Status: "OK", Ready: true}
+	}
+	return healthBody{Status: "NOT_READY", Ready: false}
 }
 
-type runtimeBody struct {
-	Branch   string `json:"branch"`
-	Revision string `json:"revision"`
-	Platform string `json:"platform"`
+// handleLogsRequests returns the latest requests, newest first.
+func handleLogsRequests(resp http.ResponseWriter, req *http.Request) {
+	if !*enableAdmin {
+		notEnabled(resp, req, "enableAdmin")
+		return
+	}
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	writeJSON(resp, req, http.StatusOK, requests.entries())
 }
 
-type requestBody struct {
-	Proto      string              `json:"proto"`
-	Host       string              `json:"host"`
-	Method     string              `json:"method"`
-	RequestURI string              `json:"requestURI"`
-	Headers    map[string][]string `json:"headers,omitempty"`
-	Form       map[string][]string `json:"form,omitempty"`
-	PostForm   map[string][]string `json:"postForm,omitempty"`
+// handleOAuth2Token mocks the token endpoint of an OAuth2 server supporting the
+// client credentials grant only. Issued tokens are random and validated nowhere.
+func handleOAuth2Token(resp http.ResponseWriter, req *http.Request) {
+	if !*enableOAuth2Mock {
+		notEnabled(resp, req, "enableOAuth2Mock")
+		return
+	}
+	if req.Method != "POST" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Header().Set("Pragma", "no-cache")
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mediaType != "application/x-www-form-urlencoded" {
+		writeJSON(resp, req, http.StatusBadRequest, oauth2ErrorBody{Error: "invalid_request"})
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeJSON(resp, req, http.StatusBadRequest, oauth2ErrorBody{Error: "invalid_request"})
+		return
+	}
+	if grantType := req.PostForm.Get("grant_type"); grantType != "client_credentials" {
+		writeJSON(resp, req, http.StatusBadRequest, oauth2ErrorBody{Error: "unsupported_grant_type"})
+		return
+	}
+	if mathrand.Float64() < *oauth2FailProbability {
+		writeJSON(resp, req, http.StatusInternalServerError, oauth2ErrorBody{Error: "server_error"})
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("ERROR creating token for %v: %v", req.RemoteAddr, err)
+		writeJSON(resp, req, http.StatusInternalServerError, oauth2ErrorBody{Error: "server_error"})
+		return
+	}
+	writeJSON(resp, req, http.StatusOK, oauth2TokenBody{
+		AccessToken: fmt.Sprintf("mock-token-%x", b),
+		TokenType:   "Bearer",
+		ExpiresIn:   3600,
+	})
+}
+
+// handleCDN serves GET requests from the cache if -simulateCDN is enabled or
+// stores the response of handleEveryThingElse in it.
+func handleCDN(resp http.ResponseWriter, req *http.Request) {
+	if !*simulateCDN || req.Method != "GET" {
+		useWorker(resp, req, handleEveryThingElse)
+		return
+	}
+	key := cdnCacheKey{canary: isCanary(req), path: req.URL.Path}
+	cdnCacheMutex.Lock()
+	entry, ok := cdnCache[key]
+	cdnCacheMutex.Unlock()
+	maxAge := time.Duration(*cdnCacheMaxAge) * time.Second
+	if ok && time.Since(entry.created) < maxAge {
+		header := resp.Header()
+		for name, values := range entry.header {
+			header[name] = values
+		}
+		header.Set("X-Cache-Status", "HIT")
+		header.Set("Age", strconv.Itoa(int(time.Since(entry.created)/time.Second)))
+		resp.WriteHeader(entry.statusCode)
+		if _, err := resp.Write(entry.body); err != nil {
+			log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+		}
+		return
+	}
+
+	resp.Header().Set("X-Cache-Status", "MISS")
+	resp.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", *cdnCacheMaxAge))
+	recorder := &statusRecorder{ResponseWriter: resp, body: new(bytes.Buffer)}
+	useWorker(recorder, req, handleEveryThingElse)
+	if recorder.statusCode != http.StatusOK || recorder.hijacked || resp.Header().Get("Set-Cookie") != "" || resp.Header().Get("Cache-Control") == "no-store" {
+		// Like a real CDN, responses containing cookies or forbidding to store
+		// them (like the ones while warming up) are never cached.
+		return
+	}
+	entry = cdnCacheEntry{
+		created:    time.Now(),
+		statusCode: recorder.statusCode,
+		header:     make(http.Header),
+		body:       recorder.body.Bytes(),
+	}
+	for name, values := range resp.Header() {
+		if !cdnUncachedHeaders[name] {
+			entry.header[name] = values
+		}
+	}
+	cdnCacheMutex.Lock()
+	cdnCache[key] = entry
+	cdnCacheMutex.Unlock()
+}
+
+// handleDNSSelf reports the addresses the own hostname resolves to.
+func handleDNSSelf(resp http.ResponseWriter, req *http.Request) {
+	if !*enableDNSSimulation {
+		notEnabled(resp, req, "enableDNSSimulation")
+		return
+	}
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("ERROR determining own hostname for %v: %v", req.RemoteAddr, err)
+		internalServerError(resp, req)
+		return
+	}
+	writeDNSLookup(resp, req, hostname)
+}
+
+// handleDNSService reports the addresses ?name= resolves to.
+func handleDNSService(resp http.ResponseWriter, req *http.Request) {
+	if !*enableDNSSimulation {
+		notEnabled(resp, req, "enableDNSSimulation")
+		return
+	}
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", "Parameter name required.")
+		return
+	}
+	writeDNSLookup(resp, req, name)
+}
+
+func writeDNSLookup(resp http.ResponseWriter, req *http.Request, hostname string) {
+	ctx, cancel := context.WithTimeout(req.Context(), *dnsLookupTimeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, hostname)
+	body := dnsLookupBody{
+		Hostname:    hostname,
+		Addrs:       addrs,
+		DNSLookupMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if err != nil {
+		writeError(resp, req, http.StatusBadGateway, "dns_lookup_failed", err.Error())
+		return
+	}
+	writeJSON(resp, req, http.StatusOK, body)
+}
+
+func handleCDNPurge(resp http.ResponseWriter, req *http.Request) {
+	if !*enableAdmin {
+		notEnabled(resp, req, "enableAdmin")
+		return
+	}
+	if req.Method != "POST" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	cdnCacheMutex.Lock()
+	purged := len(cdnCache)
+	cdnCache = make(map[cdnCacheKey]cdnCacheEntry)
+	cdnCacheMutex.Unlock()
+	log.Printf("Purged %d entries from CDN cache on behalf of %v.", purged, req.RemoteAddr)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func handleStats(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	writeJSON(resp, req, http.StatusOK, currentStats())
+}
+
+func currentStats() statsBody {
+	busy := int(atomic.LoadInt64(&workersBusy))
+	return statsBody{
+		PanicCount:     atomic.LoadInt64(&panicCount),
+		WorkerPoolSize: *workerPool,
+		WorkersBusy:    busy,
+		WorkersIdle:    *workerPool - busy,
+		Latency: latencyStatsBody{
+			P50Ms: milliseconds(latencies.Percentile(50)),
+			P95Ms: milliseconds(latencies.Percentile(95)),
+			P99Ms: milliseconds(latencies.Percentile(99)),
+		},
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func handleStatsPanics(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	body := panicStatsBody{
+		PanicCount: atomic.LoadInt64(&panicCount),
+	}
+	lastPanicMutex.Lock()
+	if !lastPanicTime.IsZero() {
+		t := lastPanicTime
+		body.LastPanicTime = &t
+		body.LastPanicMessage = lastPanicMessage
+	}
+	lastPanicMutex.Unlock()
+	writeJSON(resp, req, http.StatusOK, body)
+}
+
+// writeError writes an errorBody; all handlers report errors this way, except
+// /oauth2/token which has to follow the OAuth2 error format.
+func writeError(resp http.ResponseWriter, req *http.Request, statusCode int, code string, message string) {
+	writeJSON(resp, req, statusCode, errorBody{
+		Code:      code,
+		Message:   message,
+		RequestID: requestIDOf(req),
+		Timestamp: time.Now(),
+	})
+}
+
+// remoteIPOf returns the IP of the client. It is the real one also behind a
+// load balancer if -proxyProtocol is enabled.
+func remoteIPOf(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func requestIDOf(req *http.Request) string {
+	return req.Header.Get("X-Request-Id")
+}
+
+func writeJSON(resp http.ResponseWriter, req *http.Request, statusCode int, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(statusCode)
+	enc := json.NewEncoder(resp)
+	if *jsonIndent {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+	}
+}
+
+func handleEveryThingElse(resp http.ResponseWriter, req *http.Request) {
+	if *xFrameOptions != "" {
+		resp.Header().Set("X-Frame-Options", *xFrameOptions)
+	}
+	if d, ok := tlsHandshakeDurationOf(req); ok {
+		resp.Header().Set("X-TLS-Handshake-Ms", strconv.FormatInt(int64(d/time.Millisecond), 10))
+	}
+	format := req.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		resp.Header().Set("Content-Type", "application/json")
+	case "yaml":
+		resp.Header().Set("Content-Type", "application/yaml")
+	default:
+		writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Unsupported format: %s", format))
+		return
+	}
+	indent := *jsonIndent
+	switch plainJSON := req.URL.Query().Get("json"); plainJSON {
+	case "":
+	case "compact":
+		indent = false
+	case "pretty":
+		indent = true
+	default:
+		writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Illegal json: %s", plainJSON))
+		return
+	}
+	warming := isWarming()
+	if warming {
+		// Nobody (like -simulateCDN) should keep this reduced response.
+		resp.Header().Set("Cache-Control", "no-store")
+		if err := encodeResponseBody(resp, format, indent, warmingBodyFor()); err != nil {
+			log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+		}
+		return
+	}
+	ttfb, err := delayParameter(req, "ttfb")
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	delay, err := durationParameter(req, "delay")
+	if err == nil && delay > *maxDelay {
+		err = fmt.Errorf("illegal delay: %v exceeds the maximum delay of %v", delay, *maxDelay)
+	}
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	timeout, err := durationParameter(req, "timeout")
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	envPrefix := req.URL.Query().Get("includeEnv")
+	if envPrefix != "" && !*allowEnvEcho {
+		writeError(resp, req, http.StatusForbidden, "not_enabled", "Parameter includeEnv is not enabled. Start with -allowEnvEcho to enable.")
+		return
+	}
+	callback := req.URL.Query().Get("callback")
+	if callback != "" {
+		if !*enableJSONP {
+			parameterNotEnabled(resp, req, "callback", "enableJSONP")
+			return
+		}
+		if !jsonpCallbackPattern.MatchString(callback) {
+			writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Illegal callback: %s", callback))
+			return
+		}
+		if format == "yaml" {
+			writeError(resp, req, http.StatusBadRequest, "bad_request", "Parameter callback is only supported for JSON.")
+			return
+		}
+		resp.Header().Set("Content-Type", "application/javascript")
+	}
+	includeStack := req.URL.Query().Get("includeStack") == "true"
+	if includeStack && !*enableDebug {
+		parameterNotEnabled(resp, req, "includeStack", "enableDebug")
+		return
+	}
+	if contentDisposition := req.URL.Query().Get("contentDisposition"); contentDisposition != "" {
+		if !*allowContentDisposition {
+			parameterNotEnabled(resp, req, "contentDisposition", "allowContentDisposition")
+			return
+		}
+		if contentDisposition != "attachment" {
+			writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Illegal contentDisposition: %s", contentDisposition))
+			return
+		}
+		filename := req.URL.Query().Get("filename")
+		if filename == "" {
+			filename = "response.json"
+		}
+		if !filenamePattern.MatchString(filename) {
+			writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Illegal filename: %s", filename))
+			return
+		}
+		resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	}
+	injectedLatency, err := injectedLatencyParameter(req)
+	if err == errChaosNotEnabled {
+		parameterNotEnabled(resp, req, "inject", "enableChaos")
+		return
+	}
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	syntheticHeaders, err := syntheticHeadersParameter(req)
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	headerMutations, err := headerMutationsParameter(req)
+	if err == errMutationNotEnabled {
+		parameterNotEnabled(resp, req, "mutateHeader", "allowMutation")
+		return
+	}
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	cookies, err := setCookieParameter(req)
+	if err == errSetCookieNotEnabled {
+		parameterNotEnabled(resp, req, "set-cookie", "allowSetCookieParam")
+		return
+	}
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	largeBodyMB, err := largeBodyParameter(req)
+	if err == errLargeBodyNotEnabled {
+		parameterNotEnabled(resp, req, "body", "enableLargeBody")
+		return
+	}
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	ctx := req.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	fields, err := fieldsParameter(req)
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	statusMessage := req.URL.Query().Get("statusMessage")
+	if statusMessage != "" && !*allowCustomStatusMessage {
+		parameterNotEnabled(resp, req, "statusMessage", "allowCustomStatusMessage")
+		return
+	}
+	if strings.ContainsAny(statusMessage, "\r\n") {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", "Illegal statusMessage: must not contain line breaks")
+		return
+	}
+	if statusMessage != "" && req.ProtoMajor != 1 {
+		log.Printf("WARN custom status message requested by %v via %s is not supported and will be ignored.", req.RemoteAddr, req.Proto)
+		statusMessage = ""
+	}
+	var patchResult jsonDocument
+	if isMergePatch(req) {
+		if patchResult, err = applyMergePatch(req); err == errBodyTooLarge {
+			bodyTooLarge(resp, req)
+			return
+		} else if err != nil {
+			writeError(resp, req, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+	body := responseBodyFor(req)
+	body.PatchResult = patchResult
+	for _, cookie := range cookies {
+		http.SetCookie(resp, cookie)
+		body.CookiesSet = append(body.CookiesSet, cookie.Name)
+	}
+	if len(headerMutations) > 0 {
+		body.Request.Headers, body.MutatedHeaders = mutateHeaders(req.Header, headerMutations)
+	}
+	if envPrefix != "" {
+		body.EnvVars = envVarsWithPrefix(envPrefix)
+	}
+	if *warmupRequests > 0 {
+		body.Warming = &warming
+	}
+	if includeStack {
+		buf := make([]byte, 64*1024)
+		body.GoroutineStack = string(buf[:runtime.Stack(buf, false)])
+	}
+	if syntheticHeaders > 0 {
+		if body.TotalHeaderBytes, err = addSyntheticHeaders(resp, syntheticHeaders); err != nil {
+			log.Printf("ERROR creating synthetic headers for %v: %v", req.RemoteAddr, err)
+			internalServerError(resp, req)
+			return
+		}
+	}
+	if largeBodyMB > 0 {
+		if body.Padding, err = paddingOf(largeBodyMB * 1024 * 1024); err != nil {
+			log.Printf("ERROR creating padding for %v: %v", req.RemoteAddr, err)
+			internalServerError(resp, req)
+			return
+		}
+	}
+	if *stickySession {
+		sessionID, sessionNew := stickySessionOf(resp, req)
+		body.Request.SessionID = sessionID
+		body.Request.SessionNew = &sessionNew
+	}
+	statusCode := http.StatusOK
+	plainStatusCode := req.URL.Query().Get("statusCode")
+	if v, err := strconv.Atoi(plainStatusCode); err == nil && v >= 100 && v < 1000 {
+		statusCode = v
+	}
+	waitForCPU(ctx)
+	if injectedLatency > 0 {
+		body.InjectedLatencyMs = int(injectedLatency / time.Millisecond)
+		sleep(ctx, injectedLatency)
+	}
+	sleep(ctx, delay)
+	if ttfb > 0 {
+		body.TTFBMs = int(ttfb / time.Millisecond)
+		sleep(ctx, ttfb)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		writeError(resp, req, http.StatusGatewayTimeout, "handler_timeout", "handler timeout")
+		return
+	}
+	if ctx.Err() != nil {
+		// Client is already gone.
+		return
+	}
+	var result interface{} = body
+	if len(fields) > 0 {
+		if result, err = filterResponseBody(body, fields); err != nil {
+			log.Printf("ERROR filtering response for %v: %v", req.RemoteAddr, err)
+			internalServerError(resp, req)
+			return
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := encodeResponseBody(buf, format, indent, result); err != nil {
+		log.Printf("ERROR encoding response for %v: %v", req.RemoteAddr, err)
+		internalServerError(resp, req)
+		return
+	}
+	if callback != "" {
+		buf = wrapJSONP(callback, buf)
+	}
+	if statusMessage != "" {
+		writeWithStatusMessage(resp, req, statusCode, statusMessage, buf)
+		return
+	}
+	resp.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	resp.WriteHeader(statusCode)
+	if f, ok := resp.(http.Flusher); ok && ttfb > 0 {
+		f.Flush()
+	}
+	if _, err := buf.WriteTo(resp); err != nil {
+		log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+	}
+}
+
+func wrapJSONP(callback string, json *bytes.Buffer) *bytes.Buffer {
+	result := new(bytes.Buffer)
+	result.WriteString(callback)
+	result.WriteByte('(')
+	result.Write(bytes.TrimRight(json.Bytes(), "\n"))
+	result.WriteString(");\n")
+	return result
+}
+
+const (
+	syntheticHeaderPrefix    = "X-Synthetic-Response-Header-"
+	syntheticHeaderValueSize = 256
+)
+
+// syntheticHeadersParameter returns the number of headers requested by
+// ?responseHeaders=N. Requests exceeding -maxSyntheticHeadersSize are rejected.
+func syntheticHeadersParameter(req *http.Request) (int, error) {
+	plain := req.URL.Query().Get("responseHeaders")
+	if plain == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(plain)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("illegal responseHeaders: %s", plain)
+	}
+	// Every header has at least syntheticHeaderValueSize bytes; this rejects huge
+	// numbers before syntheticHeadersSize has to iterate over all of them.
+	if n > *maxSyntheticHeadersSize/syntheticHeaderValueSize {
+		return 0, fmt.Errorf("illegal responseHeaders: %d headers would exceed the maximum of %d bytes", n, *maxSyntheticHeadersSize)
+	}
+	if size := syntheticHeadersSize(n); size > *maxSyntheticHeadersSize {
+		return 0, fmt.Errorf("illegal responseHeaders: %d headers would be %d bytes which exceeds the maximum of %d", n, size, *maxSyntheticHeadersSize)
+	}
+	return n, nil
+}
+
+// syntheticHeadersSize returns the total size of names and values of the
+// given number of synthetic headers.
+func syntheticHeadersSize(n int) int {
+	result := 0
+	for i := 1; i <= n; i++ {
+		result += len(syntheticHeaderPrefix) + len(strconv.Itoa(i)) + syntheticHeaderValueSize
+	}
+	return result
+}
+
+func addSyntheticHeaders(resp http.ResponseWriter, n int) (int, error) {
+	for i := 1; i <= n; i++ {
+		value, err := paddingOf(syntheticHeaderValueSize)
+		if err != nil {
+			return 0, err
+		}
+		resp.Header().Set(syntheticHeaderPrefix+strconv.Itoa(i), value)
+	}
+	return syntheticHeadersSize(n), nil
+}
+
+var errChaosNotEnabled = errors.New("chaos is not enabled")
+
+// injectedLatencyParameter returns the currently observed latency percentile
+// selected by ?inject=latency&source=p50|p95|p99 (default p99), capped by
+// -maxDelay.
+func injectedLatencyParameter(req *http.Request) (time.Duration, error) {
+	inject := req.URL.Query().Get("inject")
+	if inject == "" {
+		return 0, nil
+	}
+	if !*enableChaos {
+		return 0, errChaosNotEnabled
+	}
+	if inject != "latency" {
+		return 0, fmt.Errorf("illegal inject: %s", inject)
+	}
+	var p float64
+	switch source := req.URL.Query().Get("source"); source {
+	case "p50":
+		p = 50
+	case "p95":
+		p = 95
+	case "", "p99":
+		p = 99
+	default:
+		return 0, fmt.Errorf("illegal source: %s", source)
+	}
+	result := latencies.Percentile(p)
+	if result > *maxDelay {
+		result = *maxDelay
+	}
+	return result, nil
+}
+
+var errMutationNotEnabled = errors.New("mutation is not enabled")
+
+type headerMutation struct {
+	name     string
+	oldValue string
+	newValue string
+}
+
+// headerMutationsParameter returns all mutations requested by
+// ?mutateHeader=<name>:<old value>:<new value>.
+func headerMutationsParameter(req *http.Request) ([]headerMutation, error) {
+	specs := req.URL.Query()["mutateHeader"]
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	if !*allowMutation {
+		return nil, errMutationNotEnabled
+	}
+	result := make([]headerMutation, len(specs))
+	for i, spec := range specs {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("illegal mutateHeader: %s; expected Name:OldValue:NewValue", spec)
+		}
+		result[i] = headerMutation{
+			name:     http.CanonicalHeaderKey(parts[0]),
+			oldValue: parts[1],
+			newValue: parts[2],
+		}
+	}
+	return result, nil
+}
+
+// mutateHeaders returns a copy of the given headers where every value
+// matching a mutation was replaced, together with the names of the changed
+// headers. The given headers stay untouched.
+func mutateHeaders(headers http.Header, mutations []headerMutation) (http.Header, []string) {
+	result := make(http.Header, len(headers))
+	for name, values := range headers {
+		result[name] = append([]string(nil), values...)
+	}
+	var mutated []string
+	for _, mutation := range mutations {
+		changed := false
+		for i, value := range result[mutation.name] {
+			if value == mutation.oldValue {
+				result[mutation.name][i] = mutation.newValue
+				changed = true
+			}
+		}
+		if changed && !containsString(mutated, mutation.name) {
+			mutated = append(mutated, mutation.name)
+		}
+	}
+	return result, mutated
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+var errSetCookieNotEnabled = errors.New("setting cookies is not enabled")
+
+// setCookieParameter returns all cookies requested by ?set-cookie=<name>=<value>.
+// Names and values have to be valid according to RFC 6265.
+func setCookieParameter(req *http.Request) ([]*http.Cookie, error) {
+	specs := req.URL.Query()["set-cookie"]
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	if !*allowSetCookieParam {
+		return nil, errSetCookieNotEnabled
+	}
+	result := make([]*http.Cookie, len(specs))
+	for i, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("illegal set-cookie: %s; expected Name=Value", spec)
+		}
+		name, value := parts[0], parts[1]
+		if !isCookieName(name) {
+			return nil, fmt.Errorf("illegal set-cookie: %s; illegal cookie name", spec)
+		}
+		if !isCookieValue(value) {
+			return nil, fmt.Errorf("illegal set-cookie: %s; illegal cookie value", spec)
+		}
+		result[i] = &http.Cookie{Name: name, Value: value, Path: "/"}
+	}
+	return result, nil
+}
+
+// isCookieName reports whether name is a token (RFC 6265, section 4.1.1).
+func isCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= 0x20 || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isCookieValue reports whether value consists of cookie-octets (RFC 6265,
+// section 4.1.1). Quoted values are not supported as http.SetCookie would
+// drop the quotes.
+func isCookieValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c <= 0x20 || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+var errLargeBodyNotEnabled = errors.New("large bodies are not enabled")
+
+// largeBodyParameter returns the size in megabytes requested by ?body=large&mb=N
+// or 0 if no large body was requested.
+func largeBodyParameter(req *http.Request) (int, error) {
+	plainBody := req.URL.Query().Get("body")
+	if plainBody == "" {
+		return 0, nil
+	}
+	if !*enableLargeBody {
+		return 0, errLargeBodyNotEnabled
+	}
+	if plainBody != "large" {
+		return 0, fmt.Errorf("illegal body: %s", plainBody)
+	}
+	plainMB := req.URL.Query().Get("mb")
+	mb, err := strconv.Atoi(plainMB)
+	if err != nil || mb < 1 {
+		return 0, fmt.Errorf("illegal mb: %s", plainMB)
+	}
+	if mb > *maxLargeBodyMB {
+		return 0, fmt.Errorf("illegal mb: %d exceeds the maximum of %d", mb, *maxLargeBodyMB)
+	}
+	return mb, nil
+}
+
+// paddingOf returns random base64 data of (roughly) the given size.
+func paddingOf(size int) (string, error) {
+	b := make([]byte, size/4*3)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// writeWithStatusMessage writes the whole response by itself to the hijacked
+// connection, because net/http always uses the default reason phrase.
+func writeWithStatusMessage(resp http.ResponseWriter, req *http.Request, statusCode int, statusMessage string, buf *bytes.Buffer) {
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		log.Printf("WARN custom status message requested by %v is not supported by this connection and will be ignored.", req.RemoteAddr)
+		resp.WriteHeader(statusCode)
+		if _, err := buf.WriteTo(resp); err != nil {
+			log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+		}
+		return
+	}
+	if recorder, ok := resp.(*statusRecorder); ok {
+		recorder.recordHijackedStatus(statusCode)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("ERROR hijacking connection of %v: %v", req.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	header := resp.Header()
+	header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	header.Set("Connection", "close")
+	header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if _, err := fmt.Fprintf(rw, "HTTP/1.1 %d %s\r\n", statusCode, statusMessage); err != nil {
+		log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+		return
+	}
+	if err := header.Write(rw); err != nil {
+		log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+		return
+	}
+	if _, err := rw.WriteString("\r\n"); err != nil {
+		log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+		return
+	}
+	if _, err := buf.WriteTo(rw); err != nil {
+		log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		log.Printf("ERROR writing response to %v: %v", req.RemoteAddr, err)
+	}
+}
+
+// isWarming counts the served request and reports whether it is still one of
+// the first -warmupRequests requests.
+func isWarming() bool {
+	if *warmupRequests <= 0 {
+		return false
+	}
+	served := atomic.AddInt64(&servedRequests, 1)
+	if served == int64(*warmupRequests)+1 {
+		log.Printf("Warmed up after %d requests.", *warmupRequests)
+	}
+	return served <= int64(*warmupRequests)
+}
+
+func warmingBodyFor() (result warmingBody) {
+	result.Warming = true
+	result.Runtime.Branch = branch
+	result.Runtime.Revision = revision
+	return
+}
+
+const maxEchoedEnvVars = 50
+
+// envVarsWithPrefix returns (at most maxEchoedEnvVars) environment variables
+// whose names start with the given prefix. Values of variables matching
+// -maskEnvVars are masked.
+func envVarsWithPrefix(prefix string) map[string]string {
+	var names []string
+	values := make(map[string]string)
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) {
+			continue
+		}
+		names = append(names, parts[0])
+		values[parts[0]] = parts[1]
+	}
+	sort.Strings(names)
+	if len(names) > maxEchoedEnvVars {
+		names = names[:maxEchoedEnvVars]
+	}
+	result := make(map[string]string, len(names))
+	for _, name := range names {
+		if isMaskedEnvVar(name) {
+			result[name] = "******"
+		} else {
+			result[name] = values[name]
+		}
+	}
+	return result
+}
+
+func isMaskedEnvVar(name string) bool {
+	for _, pattern := range strings.Split(*maskEnvVars, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// readBody reads the whole request body but fails with errBodyTooLarge if it
+// exceeds -maxBodySize. This also bounds decompressed bodies.
+func readBody(req *http.Request) ([]byte, error) {
+	plain, err := ioutil.ReadAll(io.LimitReader(req.Body, *maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(plain)) > *maxBodySize {
+		return nil, errBodyTooLarge
+	}
+	return plain, nil
+}
+
+func bodyTooLarge(resp http.ResponseWriter, req *http.Request) {
+	writeError(resp, req, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("Request body exceeds the maximum of %d bytes.", *maxBodySize))
+}
+
+func isMergePatch(req *http.Request) bool {
+	if req.Method != "PATCH" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/merge-patch+json"
+}
+
+// applyMergePatch applies the JSON merge patch (RFC 7396) of the request body
+// to the base document. The base document itself stays untouched.
+func applyMergePatch(req *http.Request) (jsonDocument, error) {
+	plain, err := readBody(req)
+	if err == errBodyTooLarge {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read merge patch: %v", err)
+	}
+	var patch interface{}
+	if err := json.Unmarshal(plain, &patch); err != nil {
+		return nil, fmt.Errorf("illegal merge patch: %v", err)
+	}
+	var target interface{}
+	baseDocumentMutex.RLock()
+	err = json.Unmarshal(baseDocument, &target)
+	baseDocumentMutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("illegal base document: %v", err)
+	}
+	return json.Marshal(mergePatch(target, patch))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// handlePatchBase replaces the document merge patches are applied to.
+func handlePatchBase(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "PUT" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	plain, err := readBody(req)
+	if err == errBodyTooLarge {
+		bodyTooLarge(resp, req)
+		return
+	}
+	if err != nil {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Cannot read base document: %v", err))
+		return
+	}
+	if !json.Valid(plain) {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", "Illegal base document: not valid JSON")
+		return
+	}
+	baseDocumentMutex.Lock()
+	baseDocument = plain
+	baseDocumentMutex.Unlock()
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// fieldsParameter parses ?fields=a,b.c into its dot separated paths. Every path
+// has to match a field of responseBody; keys of maps (like headers) are free.
+func fieldsParameter(req *http.Request) ([][]string, error) {
+	plain := req.URL.Query().Get("fields")
+	if plain == "" {
+		return nil, nil
+	}
+	var result [][]string
+	for _, field := range strings.Split(plain, ",") {
+		path := strings.Split(field, ".")
+		if !isKnownField(reflect.TypeOf(responseBody{}), path) {
+			return nil, fmt.Errorf("illegal field: %s", field)
+		}
+		result = append(result, path)
+	}
+	return result, nil
+}
+
+func isKnownField(t reflect.Type, path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if name := strings.Split(f.Tag.Get("json"), ",")[0]; name == path[0] {
+				return isKnownField(f.Type, path[1:])
+			}
+		}
+	case reflect.Map:
+		return path[0] != "" && isKnownField(t.Elem(), path[1:])
+	}
+	return false
+}
+
+// filterResponseBody returns the JSON representation of the given body reduced
+// to the given field paths.
+func filterResponseBody(body responseBody, fields [][]string) (map[string]interface{}, error) {
+	plain, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var source map[string]interface{}
+	if err := json.Unmarshal(plain, &source); err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{})
+	for _, path := range fields {
+		copyField(source, result, path)
+	}
+	return result, nil
+}
+
+func copyField(source, target map[string]interface{}, path []string) {
+	v, ok := source[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		target[path[0]] = v
+		return
+	}
+	sourceChild, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	targetChild, ok := target[path[0]].(map[string]interface{})
+	if !ok {
+		targetChild = make(map[string]interface{})
+		target[path[0]] = targetChild
+	}
+	copyField(sourceChild, targetChild, path[1:])
+}
+
+// encodeResponseBody writes the body in the given format. The indent flag only
+// affects JSON; YAML is always indented.
+func encodeResponseBody(resp io.Writer, format string, indent bool, body interface{}) error {
+	if format == "yaml" {
+		enc := yaml.NewEncoder(resp)
+		enc.SetIndent(2)
+		if err := enc.Encode(body); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	enc := json.NewEncoder(resp)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(body)
+}
+
+// delayParameter parses the query parameter with the given name as milliseconds.
+// A missing parameter results in 0. Values above -maxDelay are rejected.
+func delayParameter(req *http.Request, name string) (time.Duration, error) {
+	plain := req.URL.Query().Get(name)
+	if plain == "" {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(plain)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("illegal %s: %s", name, plain)
+	}
+	// Compared before the conversion, as huge values would overflow the duration.
+	if int64(ms) > int64(*maxDelay/time.Millisecond) {
+		return 0, fmt.Errorf("illegal %s: %s exceeds the maximum delay of %v", name, plain, *maxDelay)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// durationParameter parses the query parameter with the given name as
+// duration (like 100ms). A missing parameter results in 0.
+func durationParameter(req *http.Request, name string) (time.Duration, error) {
+	plain := req.URL.Query().Get(name)
+	if plain == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(plain)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("illegal %s: %s", name, plain)
+	}
+	return d, nil
+}
+
+// sleep waits for the given duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func stickySessionOf(resp http.ResponseWriter, req *http.Request) (id string, isNew bool) {
+	if cookie, err := req.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		log.Printf("Sticky session: %s", cookie.Value)
+		return cookie.Value, false
+	}
+	id, err := newUUID()
+	if err != nil {
+		log.Printf("ERROR creating new session for %v: %v", req.RemoteAddr, err)
+		return "", false
+	}
+	http.SetCookie(resp, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   3600,
+	})
+	return id, true
+}
+
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func responseBodyFor(req *http.Request) (result responseBody) {
+	result.Runtime.Branch = branch
+	result.Runtime.Revision = revision
+	result.Runtime.Platform = runtime.GOOS + "-" + runtime.GOARCH
+	result.Runtime.IsCanary = isCanary(req)
+
+	result.Request.Proto = req.Proto
+	result.Request.Host = req.Host
+	result.Request.Method = req.Method
+	result.Request.RemoteIP = remoteIPOf(req)
+	result.Request.RequestURI = req.RequestURI
+	result.Request.Headers = req.Header
+	result.Request.Form = req.Form
+	result.Request.PostForm = req.PostForm
+	return
+}
+
+type responseBody struct {
+	Runtime runtimeBody `json:"runtime" yaml:"runtime"`
+	Request requestBody `json:"request" yaml:"request"`
+	TTFBMs  int         `json:"ttfbMs,omitempty" yaml:"ttfbMs,omitempty"`
+
+	InjectedLatencyMs int `json:"injectedLatencyMs,omitempty" yaml:"injectedLatencyMs,omitempty"`
+
+	PatchResult jsonDocument      `json:"patchResult,omitempty" yaml:"patchResult,omitempty"`
+	Warming     *bool             `json:"warming,omitempty" yaml:"warming,omitempty"`
+	EnvVars     map[string]string `json:"envVars,omitempty" yaml:"envVars,omitempty"`
+	Padding     string            `json:"padding,omitempty" yaml:"padding,omitempty"`
+
+	TotalHeaderBytes int `json:"totalHeaderBytes,omitempty" yaml:"totalHeaderBytes,omitempty"`
+
+	MutatedHeaders []string `json:"mutatedHeaders,omitempty" yaml:"mutatedHeaders,omitempty"`
+	CookiesSet     []string `json:"cookiesSet,omitempty" yaml:"cookiesSet,omitempty"`
+
+	GoroutineStack string `json:"goroutineStack,omitempty" yaml:"goroutineStack,omitempty"`
+}
+
+// jsonDocument is an already encoded JSON document which is embedded as it is
+// into JSON responses and as the equivalent YAML into YAML responses.
+type jsonDocument json.RawMessage
+
+func (instance jsonDocument) MarshalJSON() ([]byte, error) {
+	return json.RawMessage(instance).MarshalJSON()
+}
+
+func (instance jsonDocument) MarshalYAML() (interface{}, error) {
+	var result interface{}
+	if err := json.Unmarshal(instance, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type warmingBody struct {
+	Warming bool `json:"warming" yaml:"warming"`
+	Runtime struct {
+		Branch   string `json:"branch" yaml:"branch"`
+		Revision string `json:"revision" yaml:"revision"`
+	} `json:"runtime" yaml:"runtime"`
+}
+
+type runtimeBody struct {
+	Branch   string `json:"branch" yaml:"branch"`
+	Revision string `json:"revision" yaml:"revision"`
+	Platform string `json:"platform" yaml:"platform"`
+	IsCanary bool   `json:"isCanary" yaml:"isCanary"`
+}
+
+type requestBody struct {
+	Proto      string              `json:"proto" yaml:"proto"`
+	Host       string              `json:"host" yaml:"host"`
+	Method     string              `json:"method" yaml:"method"`
+	RemoteIP   string              `json:"remoteIP" yaml:"remoteIP"`
+	RequestURI string              `json:"requestURI" yaml:"requestURI"`
+	Headers    map[string][]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Form       map[string][]string `json:"form,omitempty" yaml:"form,omitempty"`
+	PostForm   map[string][]string `json:"postForm,omitempty" yaml:"postForm,omitempty"`
+	SessionID  string              `json:"sessionId,omitempty" yaml:"sessionId,omitempty"`
+	SessionNew *bool               `json:"sessionNew,omitempty" yaml:"sessionNew,omitempty"`
+}
+
+type errorBody struct {
+	Code      string    `json:"code"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"requestId,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type healthBody struct {
+	Status string `json:"status"`
+	Ready  bool   `json:"ready"`
+}
+
+type verboseHealthBody struct {
+	Health healthBody `json:"health"`
+	Stats  statsBody  `json:"stats"`
+}
+
+type statsBody struct {
+	PanicCount     int64            `json:"panicCount"`
+	WorkerPoolSize int              `json:"workerPoolSize"`
+	WorkersBusy    int              `json:"workersBusy"`
+	WorkersIdle    int              `json:"workersIdle"`
+	Latency        latencyStatsBody `json:"latency"`
+}
+
+type latencyStatsBody struct {
+	P50Ms float64 `json:"p50Ms"`
+	P95Ms float64 `json:"p95Ms"`
+	P99Ms float64 `json:"p99Ms"`
+}
+
+type panicStatsBody struct {
+	PanicCount       int64      `json:"panicCount"`
+	LastPanicTime    *time.Time `json:"lastPanicTime,omitempty"`
+	LastPanicMessage string     `json:"lastPanicMessage,omitempty"`
+}
+
+// durationWindow keeps the latest durations to calculate a rolling average.
+type durationWindow struct {
+	mutex  sync.Mutex
+	values [100]time.Duration
+	next   int
+	count  int
+}
+
+func (instance *durationWindow) record(d time.Duration) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.values[instance.next] = d
+	instance.next = (instance.next + 1) % len(instance.values)
+	if instance.count < len(instance.values) {
+		instance.count++
+	}
+}
+
+func (instance *durationWindow) average() time.Duration {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if instance.count == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 0; i < instance.count; i++ {
+		sum += instance.values[i]
+	}
+	return sum / time.Duration(instance.count)
+}
+
+type slowReadBody struct {
+	BytesRead  int64 `json:"bytesRead"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+type dnsLookupBody struct {
+	Hostname    string   `json:"hostname"`
+	Addrs       []string `json:"addrs"`
+	DNSLookupMs int64    `json:"dnsLookupMs"`
+}
+
+type cpuLimitBody struct {
+	CPUPercent int `json:"cpuPercent"`
+}
+
+// partitionGate lets new requests wait until a simulated partition is over.
+type partitionGate struct {
+	mutex sync.Mutex
+	end   time.Time
+}
+
+// begin starts a partition of the given duration or extends the current one.
+func (instance *partitionGate) begin(d time.Duration) {
+	end := time.Now().Add(d)
+	instance.mutex.Lock()
+	if end.After(instance.end) {
+		instance.end = end
+	}
+	instance.mutex.Unlock()
+	time.AfterFunc(d, func() {
+		if instance.remaining() <= 0 {
+			log.Printf("Simulated partition is over.")
+		}
+	})
+}
+
+func (instance *partitionGate) remaining() time.Duration {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	return time.Until(instance.end)
+}
+
+// wait blocks while a partition is in progress or until the context is done.
+func (instance *partitionGate) wait(ctx context.Context) {
+	for ctx.Err() == nil {
+		remaining := instance.remaining()
+		if remaining <= 0 {
+			return
+		}
+		sleep(ctx, remaining)
+	}
+}
+
+type partitionBody struct {
+	DurationMs int `json:"durationMs"`
+}
+
+// statusRecorder remembers the status code written by the delegate handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	// body receives a copy of everything written, if set.
+	body *bytes.Buffer
+	// hijacked is set if the response was written directly to the connection
+	// and therefore body does not contain it.
+	hijacked bool
+}
+
+// recordHijackedStatus remembers the status code of a response written
+// directly to the hijacked connection, which bypasses WriteHeader. It is
+// passed on to wrapped recorders.
+func (instance *statusRecorder) recordHijackedStatus(statusCode int) {
+	instance.hijacked = true
+	if instance.statusCode == 0 {
+		instance.statusCode = statusCode
+	}
+	if inner, ok := instance.ResponseWriter.(*statusRecorder); ok {
+		inner.recordHijackedStatus(statusCode)
+	}
+}
+
+func (instance *statusRecorder) WriteHeader(statusCode int) {
+	if instance.statusCode == 0 {
+		instance.statusCode = statusCode
+	}
+	instance.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (instance *statusRecorder) Write(b []byte) (int, error) {
+	if instance.statusCode == 0 {
+		instance.statusCode = http.StatusOK
+	}
+	if instance.body != nil {
+		instance.body.Write(b)
+	}
+	return instance.ResponseWriter.Write(b)
+}
+
+func (instance *statusRecorder) Flush() {
+	if f, ok := instance.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (instance *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := instance.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+type requestLogEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+	RemoteIP   string    `json:"remoteIP"`
+	RequestID  string    `json:"requestId,omitempty"`
+}
+
+// requestLog is a ring buffer holding the latest requestLogEntry.
+type requestLog struct {
+	mutex  sync.Mutex
+	values []requestLogEntry
+	next   int
+	count  int
+}
+
+func newRequestLog(size int) *requestLog {
+	if size < 0 {
+		size = 0
+	}
+	return &requestLog{
+		values: make([]requestLogEntry, size),
+	}
+}
+
+func (instance *requestLog) add(entry requestLogEntry) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if len(instance.values) == 0 {
+		return
+	}
+	instance.values[instance.next] = entry
+	instance.next = (instance.next + 1) % len(instance.values)
+	if instance.count < len(instance.values) {
+		instance.count++
+	}
+}
+
+// entries returns all entries, newest first.
+func (instance *requestLog) entries() []requestLogEntry {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	result := make([]requestLogEntry, instance.count)
+	for i := range result {
+		result[i] = instance.values[(instance.next-1-i+len(instance.values))%len(instance.values)]
+	}
+	return result
+}
+
+type oauth2TokenBody struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type oauth2ErrorBody struct {
+	Error string `json:"error"`
+}
+
+// cdnUncachedHeaders are specific to the connection or to the cache lookup
+// itself and are never replayed from the cache.
+var cdnUncachedHeaders = map[string]bool{
+	"X-Cache-Status":     true,
+	"X-Tls-Handshake-Ms": true,
+	"Connection":         true,
+}
+
+// cdnCacheKey separates the entries of the -listen and -listenCanary server
+// because their responses differ in runtime.isCanary.
+type cdnCacheKey struct {
+	canary bool
+	path   string
+}
+
+type cdnCacheEntry struct {
+	created    time.Time
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+const cpuThrottleWindow = 100 * time.Millisecond
+
+type cpuThrottle struct {
+	percent int
+	start   time.Time
+	stop    chan struct{}
+}
+
+func (instance *cpuThrottle) runDuration() time.Duration {
+	return cpuThrottleWindow * time.Duration(instance.percent) / 100
+}
+
+// remainingThrottling returns how long it takes from the given time on until
+// the service may run again.
+func (instance *cpuThrottle) remainingThrottling(now time.Time) time.Duration {
+	offset := now.Sub(instance.start) % cpuThrottleWindow
+	if offset < instance.runDuration() {
+		return 0
+	}
+	return cpuThrottleWindow - offset
+}
+
+// burn keeps one CPU busy during the running part of every window until stopped.
+func (instance *cpuThrottle) burn() {
+	for {
+		select {
+		case <-instance.stop:
+			return
+		default:
+		}
+		now := time.Now()
+		if remaining := instance.remainingThrottling(now); remaining > 0 {
+			time.Sleep(remaining)
+			continue
+		}
+		windowEnd := now.Add(instance.runDuration() - now.Sub(instance.start)%cpuThrottleWindow)
+		for time.Now().Before(windowEnd) {
+			// Busy loop on purpose.
+		}
+	}
+}
+
+// latencyTracker keeps the latest request durations (in nanoseconds) in a
+// ring buffer to calculate percentiles of them.
+type latencyTracker struct {
+	mutex  sync.Mutex
+	values []int64
+	next   int
+	count  int
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	if size < 0 {
+		size = 0
+	}
+	return &latencyTracker{
+		values: make([]int64, size),
+	}
+}
+
+func (instance *latencyTracker) Record(d time.Duration) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if len(instance.values) == 0 {
+		return
+	}
+	instance.values[instance.next] = int64(d)
+	instance.next = (instance.next + 1) % len(instance.values)
+	if instance.count < len(instance.values) {
+		instance.count++
+	}
+}
+
+// Percentile returns the p-th (0-100) percentile of the recorded durations
+// or 0 if nothing was recorded yet.
+func (instance *latencyTracker) Percentile(p float64) time.Duration {
+	instance.mutex.Lock()
+	values := make([]int64, instance.count)
+	copy(values, instance.values[:instance.count])
+	instance.mutex.Unlock()
+	if len(values) == 0 {
+		return 0
+	}
+	k := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if k < 0 {
+		k = 0
+	} else if k >= len(values) {
+		k = len(values) - 1
+	}
+	return time.Duration(selectNth(values, k))
+}
+
+// selectNth returns the k-th smallest value by partially sorting values
+// (quickselect); values is reordered in place.
+func selectNth(values []int64, k int) int64 {
+	left, right := 0, len(values)-1
+	for left < right {
+		pivot := values[(left+right)/2]
+		i, j := left, right
+		for i <= j {
+			for values[i] < pivot {
+				i++
+			}
+			for values[j] > pivot {
+				j--
+			}
+			if i <= j {
+				values[i], values[j] = values[j], values[i]
+				i++
+				j--
+			}
+		}
+		if k <= j {
+			right = j
+		} else if k >= i {
+			left = i
+		} else {
+			break
+		}
+	}
+	return values[k]
+}
+
+const (
+	proxyProtocolMaxHeaderLength = 107
+	proxyProtocolHeaderTimeout   = 5 * time.Second
+)
+
+// proxyProtocolListener accepts connections that start with a PROXY protocol
+// v1 header and reports the client address of it as RemoteAddr.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (instance *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := instance.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, proxyProtocolMaxHeaderLength),
+	}, nil
+}
+
+// proxyProtocolConn reads the header lazily on first use; Accept itself must
+// not block on slow clients.
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (instance *proxyProtocolConn) Read(b []byte) (int, error) {
+	instance.once.Do(instance.readHeader)
+	if instance.err != nil {
+		return 0, instance.err
+	}
+	return instance.reader.Read(b)
+}
+
+func (instance *proxyProtocolConn) RemoteAddr() net.Addr {
+	instance.once.Do(instance.readHeader)
+	if instance.remoteAddr != nil {
+		return instance.remoteAddr
+	}
+	return instance.Conn.RemoteAddr()
+}
+
+func (instance *proxyProtocolConn) readHeader() {
+	if err := instance.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout)); err != nil {
+		instance.err = err
+		return
+	}
+	defer func() {
+		_ = instance.Conn.SetReadDeadline(time.Time{})
+	}()
+	line, err := instance.reader.ReadSlice('\n')
+	if err != nil {
+		instance.err = fmt.Errorf("cannot read PROXY protocol header from %v: %v", instance.Conn.RemoteAddr(), err)
+		log.Printf("ERROR %v", instance.err)
+		return
+	}
+	addr, err := parseProxyProtocolHeader(string(line))
+	if err != nil {
+		instance.err = fmt.Errorf("illegal PROXY protocol header from %v: %v", instance.Conn.RemoteAddr(), err)
+		log.Printf("ERROR %v", instance.err)
+		return
+	}
+	instance.remoteAddr = addr
+}
+
+// dialWithProxyProtocol connects like a load balancer would do: it starts with
+// a PROXY protocol v1 header which carries the own address as client.
+func dialWithProxyProtocol(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, proxyProtocolHeaderOf(conn.LocalAddr(), conn.RemoteAddr())); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func proxyProtocolHeaderOf(source, destination net.Addr) string {
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		return "PROXY UNKNOWN\r\n"
+	}
+	protocol := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		protocol = "TCP6"
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", protocol, src.IP, dst.IP, src.Port, dst.Port)
+}
+
+// parseProxyProtocolHeader parses "PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n"
+// and returns the source address. For "PROXY UNKNOWN" it returns nil.
+func parseProxyProtocolHeader(line string) (net.Addr, error) {
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("missing CRLF")
+	}
+	parts := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if len(parts) < 2 || parts[0] != "PROXY" {
+		return nil, errors.New("missing PROXY signature")
+	}
+	if parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if parts[1] != "TCP4" && parts[1] != "TCP6" {
+		return nil, fmt.Errorf("unsupported protocol %s", parts[1])
+	}
+	if len(parts) != 6 {
+		return nil, errors.New("unexpected number of fields")
+	}
+	ip := net.ParseIP(parts[2])
+	if ip == nil || net.ParseIP(parts[3]) == nil {
+		return nil, errors.New("illegal address")
+	}
+	port, err := strconv.Atoi(parts[4])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("illegal source port %s", parts[4])
+	}
+	if dstPort, err := strconv.Atoi(parts[5]); err != nil || dstPort < 0 || dstPort > 65535 {
+		return nil, fmt.Errorf("illegal destination port %s", parts[5])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// mockSchema is the supported subset of JSON schema to describe mocked
+// response bodies.
+type mockSchema struct {
+	Type       string                 `json:"type"`
+	Properties map[string]*mockSchema `json:"properties,omitempty"`
+	Items      *mockSchema            `json:"items,omitempty"`
+}
+
+// handleMock responds with a random instance of the schema
+// <-mockSchemasDir>/<schemaName>.json.
+func handleMock(resp http.ResponseWriter, req *http.Request) {
+	if !*enableMock {
+		notEnabled(resp, req, "enableMock")
+		return
+	}
+	if req.Method != "GET" {
+		methodNotAllowed(resp, req)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/mock/")
+	if !filenamePattern.MatchString(name) {
+		writeError(resp, req, http.StatusBadRequest, "bad_request", fmt.Sprintf("Illegal schema name: %s", name))
+		return
+	}
+	content, err := ioutil.ReadFile(path.Join(*mockSchemasDir, name+".json"))
+	if os.IsNotExist(err) {
+		writeError(resp, req, http.StatusNotFound, "schema_not_found", fmt.Sprintf("Schema %s not found.", name))
+		return
+	} else if err != nil {
+		log.Printf("ERROR reading schema %s for %v: %v", name, req.RemoteAddr, err)
+		internalServerError(resp, req)
+		return
+	}
+	var schema mockSchema
+	if err := json.Unmarshal(content, &schema); err != nil {
+		log.Printf("ERROR parsing schema %s for %v: %v", name, req.RemoteAddr, err)
+		internalServerError(resp, req)
+		return
+	}
+	instance, err := schema.instance()
+	if err != nil {
+		log.Printf("ERROR generating instance of schema %s for %v: %v", name, req.RemoteAddr, err)
+		internalServerError(resp, req)
+		return
+	}
+	writeJSON(resp, req, http.StatusOK, instance)
+}
+
+const mockMaxArrayItems = 5
+
+func (instance *mockSchema) instance() (interface{}, error) {
+	switch instance.Type {
+	case "string":
+		return fmt.Sprintf("%x", mathrand.Int63()), nil
+	case "number":
+		return mathrand.Float64() * 1000, nil
+	case "integer":
+		return mathrand.Intn(1000), nil
+	case "boolean":
+		return mathrand.Intn(2) == 1, nil
+	case "object":
+		result := make(map[string]interface{}, len(instance.Properties))
+		for name, property := range instance.Properties {
+			if property == nil {
+				return nil, fmt.Errorf("property %s without schema", name)
+			}
+			value, err := property.instance()
+			if err != nil {
+				return nil, fmt.Errorf("property %s: %v", name, err)
+			}
+			result[name] = value
+		}
+		return result, nil
+	case "array":
+		if instance.Items == nil {
+			return nil, errors.New("array without items")
+		}
+		result := make([]interface{}, mathrand.Intn(mockMaxArrayItems+1))
+		for i := range result {
+			value, err := instance.Items.instance()
+			if err != nil {
+				return nil, fmt.Errorf("items: %v", err)
+			}
+			result[i] = value
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %q", instance.Type)
+	}
 }
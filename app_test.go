@@ -0,0 +1,2002 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"gopkg.in/yaml.v3"
+)
+
+// setFlag sets the flag with the given name and returns a function which
+// restores its previous value.
+func setFlag(t *testing.T, name, value string) func() {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("unknown flag -%s", name)
+	}
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatalf("cannot set -%s=%s: %v", name, value, err)
+	}
+	return func() {
+		_ = f.Value.Set(old)
+	}
+}
+
+// setReadyState sets the ready state and returns a function which restores
+// the previous one.
+func setReadyState(v bool) func() {
+	old := ready.Load().(bool)
+	ready.Store(v)
+	return func() {
+		ready.Store(old)
+	}
+}
+
+// serve lets the whole handler chain of a server serve the request.
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newServer("").Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func get(target string) *httptest.ResponseRecorder {
+	return serve(httptest.NewRequest("GET", target, nil))
+}
+
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("cannot decode response %q: %v", rec.Body.String(), err)
+	}
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, expected int) {
+	t.Helper()
+	if rec.Code != expected {
+		t.Fatalf("expected status %d but got %d: %s", expected, rec.Code, rec.Body.String())
+	}
+}
+
+func TestHealthHead(t *testing.T) {
+	for _, r := range []bool{true, false} {
+		restore := setReadyState(r)
+		getRec := get("/healthz")
+		headRec := serve(httptest.NewRequest("HEAD", "/healthz", nil))
+		restore()
+
+		if headRec.Code != getRec.Code {
+			t.Errorf("ready=%v: expected status %d of GET but got %d", r, getRec.Code, headRec.Code)
+		}
+		if headRec.Body.Len() != 0 {
+			t.Errorf("ready=%v: expected no body but got %q", r, headRec.Body.String())
+		}
+		if contentType := headRec.Header().Get("Content-Type"); contentType != "text/plain" {
+			t.Errorf("ready=%v: expected Content-Type text/plain but got %q", r, contentType)
+		}
+	}
+}
+
+func TestFormatYAML(t *testing.T) {
+	rec := get("/?format=yaml")
+	expectStatus(t, rec, http.StatusOK)
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/yaml" {
+		t.Errorf("expected Content-Type application/yaml but got %q", contentType)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "runtime:") {
+		t.Errorf("expected YAML starting with runtime: but got %q", rec.Body.String())
+	}
+	var body responseBody
+	if err := yaml.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("cannot decode YAML response: %v", err)
+	}
+	if body.Request.Method != "GET" {
+		t.Errorf("expected request.method GET but got %q", body.Request.Method)
+	}
+}
+
+func TestFormatJSONIsDefault(t *testing.T) {
+	for _, target := range []string{"/", "/?format=json"} {
+		rec := get(target)
+		expectStatus(t, rec, http.StatusOK)
+		if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: expected Content-Type application/json but got %q", target, contentType)
+		}
+		var body responseBody
+		decodeJSON(t, rec, &body)
+	}
+}
+
+func TestFormatUnsupported(t *testing.T) {
+	expectStatus(t, get("/?format=xml"), http.StatusBadRequest)
+}
+
+func TestStickySession(t *testing.T) {
+	defer setFlag(t, "stickySession", "true")()
+
+	first := get("/")
+	expectStatus(t, first, http.StatusOK)
+	var cookie *http.Cookie
+	for _, candidate := range first.Result().Cookies() {
+		if candidate.Name == sessionCookieName {
+			cookie = candidate
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("expected %s cookie but got Set-Cookie %q", sessionCookieName, first.Header()["Set-Cookie"])
+	}
+	if !cookie.HttpOnly || cookie.Path != "/" || cookie.MaxAge != 3600 {
+		t.Errorf("expected HttpOnly cookie with Path=/ and Max-Age=3600 but got %q", first.Header().Get("Set-Cookie"))
+	}
+	var firstBody responseBody
+	decodeJSON(t, first, &firstBody)
+	if firstBody.Request.SessionNew == nil || !*firstBody.Request.SessionNew || firstBody.Request.SessionID != cookie.Value {
+		t.Errorf("expected new session %s but got %+v", cookie.Value, firstBody.Request)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	second := serve(req)
+	expectStatus(t, second, http.StatusOK)
+	if setCookie := second.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Errorf("expected no new cookie but got %q", setCookie)
+	}
+	var secondBody responseBody
+	decodeJSON(t, second, &secondBody)
+	if secondBody.Request.SessionNew == nil || *secondBody.Request.SessionNew || secondBody.Request.SessionID != cookie.Value {
+		t.Errorf("expected existing session %s but got %+v", cookie.Value, secondBody.Request)
+	}
+}
+
+// newTestServer starts a real server with the handler chain of newServer.
+func newTestServer() *httptest.Server {
+	return httptest.NewServer(newServer("").Handler)
+}
+
+func TestTTFB(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	var firstByte time.Time
+	req, err := http.NewRequest("GET", ts.URL+"/?ttfb=100", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			firstByte = time.Now()
+		},
+	}))
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body responseBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if ttfb := firstByte.Sub(start); ttfb < 100*time.Millisecond {
+		t.Errorf("expected first byte after at least 100ms but got it after %v", ttfb)
+	}
+	if body.TTFBMs != 100 {
+		t.Errorf("expected ttfbMs 100 but got %d", body.TTFBMs)
+	}
+}
+
+func TestTTFBExceedingMaxDelay(t *testing.T) {
+	defer setFlag(t, "maxDelay", "50ms")()
+	expectStatus(t, get("/?ttfb=100"), http.StatusBadRequest)
+
+	// In nanoseconds these overflow to a negative and to a small duration.
+	for _, ttfb := range []string{"9223372036854775807", "18446744073710"} {
+		expectStatus(t, get("/?ttfb="+ttfb), http.StatusBadRequest)
+	}
+}
+
+func TestRecoveryCountsPanics(t *testing.T) {
+	before := atomic.LoadInt64(&panicCount)
+	rec := httptest.NewRecorder()
+	withRecovery(func(http.ResponseWriter, *http.Request) {
+		panic("expected test panic")
+	})(rec, httptest.NewRequest("GET", "/", nil))
+	expectStatus(t, rec, http.StatusInternalServerError)
+
+	var stats statsBody
+	decodeJSON(t, get("/stats"), &stats)
+	if stats.PanicCount != before+1 {
+		t.Errorf("expected panicCount %d but got %d", before+1, stats.PanicCount)
+	}
+	var panics panicStatsBody
+	decodeJSON(t, get("/stats/panics"), &panics)
+	if panics.PanicCount != before+1 {
+		t.Errorf("expected panicCount %d but got %d", before+1, panics.PanicCount)
+	}
+	if panics.LastPanicTime == nil || panics.LastPanicMessage != "expected test panic" {
+		t.Errorf("expected last panic to be reported but got %+v", panics)
+	}
+}
+
+func TestFieldsFilter(t *testing.T) {
+	var body map[string]interface{}
+	decodeJSON(t, get("/?fields=runtime"), &body)
+	if _, ok := body["runtime"]; !ok || len(body) != 1 {
+		t.Errorf("expected only runtime but got %v", body)
+	}
+
+	var nested map[string]map[string]interface{}
+	decodeJSON(t, get("/?fields=request.method,request.host"), &nested)
+	if len(nested) != 1 || len(nested["request"]) != 2 || nested["request"]["method"] != "GET" {
+		t.Errorf("expected only request.method and request.host but got %v", nested)
+	}
+}
+
+func TestFieldsFilterWithoutFields(t *testing.T) {
+	var body map[string]interface{}
+	decodeJSON(t, get("/?fields="), &body)
+	if _, ok := body["runtime"]; !ok {
+		t.Errorf("expected full body but got %v", body)
+	}
+	if _, ok := body["request"]; !ok {
+		t.Errorf("expected full body but got %v", body)
+	}
+}
+
+func TestFieldsFilterUnknownField(t *testing.T) {
+	for _, fields := range []string{"unknown", "runtime.unknown", "request..method"} {
+		expectStatus(t, get("/?fields="+fields), http.StatusBadRequest)
+	}
+}
+
+func TestConcurrencyLimitRetryAfter(t *testing.T) {
+	limit := semaphore.NewWeighted(1)
+	concurrencyLimit = limit
+	defer func() {
+		concurrencyLimit = nil
+	}()
+	if !limit.TryAcquire(1) {
+		t.Fatal("cannot saturate the limit")
+	}
+	defer limit.Release(1)
+
+	rec := get("/")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Errorf("expected positive Retry-After but got %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+func mergePatchRequest(target, patch string) *http.Request {
+	req := httptest.NewRequest("PATCH", target, strings.NewReader(patch))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	return req
+}
+
+func setBaseDocument(t *testing.T, document string) {
+	t.Helper()
+	expectStatus(t, serve(httptest.NewRequest("PUT", "/patch/base", strings.NewReader(document))), http.StatusNoContent)
+}
+
+func TestMergePatch(t *testing.T) {
+	defer setBaseDocument(t, `{}`)
+	setBaseDocument(t, `{"a":1,"b":{"c":2,"d":3}}`)
+
+	rec := serve(mergePatchRequest("/", `{"b":{"c":null,"e":4},"f":[5]}`))
+	expectStatus(t, rec, http.StatusOK)
+	var body struct {
+		PatchResult map[string]interface{} `json:"patchResult"`
+	}
+	decodeJSON(t, rec, &body)
+	expected := map[string]interface{}{
+		"a": 1.0,
+		"b": map[string]interface{}{"d": 3.0, "e": 4.0},
+		"f": []interface{}{5.0},
+	}
+	if !reflect.DeepEqual(body.PatchResult, expected) {
+		t.Errorf("expected patchResult %v but got %v", expected, body.PatchResult)
+	}
+
+	// The base document itself stays untouched.
+	var unpatched struct {
+		PatchResult map[string]interface{} `json:"patchResult"`
+	}
+	decodeJSON(t, serve(mergePatchRequest("/", `{}`)), &unpatched)
+	if _, ok := unpatched.PatchResult["f"]; ok {
+		t.Errorf("expected untouched base document but got %v", unpatched.PatchResult)
+	}
+}
+
+func TestMergePatchInvalid(t *testing.T) {
+	expectStatus(t, serve(mergePatchRequest("/", `{"a":`)), http.StatusBadRequest)
+	expectStatus(t, serve(httptest.NewRequest("PUT", "/patch/base", strings.NewReader(`{"a":`))), http.StatusBadRequest)
+	expectStatus(t, serve(httptest.NewRequest("POST", "/patch/base", strings.NewReader(`{}`))), http.StatusMethodNotAllowed)
+}
+
+func TestMergePatchYAML(t *testing.T) {
+	rec := serve(mergePatchRequest("/?format=yaml", `{"a":1}`))
+	expectStatus(t, rec, http.StatusOK)
+	var body struct {
+		PatchResult map[string]interface{} `yaml:"patchResult"`
+	}
+	if err := yaml.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("cannot decode YAML response: %v", err)
+	}
+	if body.PatchResult["a"] != 1 {
+		t.Errorf("expected patchResult a: 1 but got %v", body.PatchResult)
+	}
+}
+
+func TestMergePatchExceedingMaxBodySize(t *testing.T) {
+	defer setFlag(t, "maxBodySize", "10")()
+	expectStatus(t, serve(mergePatchRequest("/", `{"a":"0123456789"}`)), http.StatusRequestEntityTooLarge)
+	expectStatus(t, serve(httptest.NewRequest("PUT", "/patch/base", strings.NewReader(`{"a":"0123456789"}`))), http.StatusRequestEntityTooLarge)
+}
+
+func TestSimulatePartition(t *testing.T) {
+	defer setFlag(t, "enableChaos", "true")()
+
+	rec := serve(httptest.NewRequest("POST", "/simulate/partition?durationMs=200", nil))
+	expectStatus(t, rec, http.StatusAccepted)
+	var body partitionBody
+	decodeJSON(t, rec, &body)
+	if body.DurationMs != 200 {
+		t.Errorf("expected durationMs 200 but got %d", body.DurationMs)
+	}
+
+	// Starting another partition is still possible during the partition.
+	start := time.Now()
+	expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/partition?durationMs=50", nil)), http.StatusAccepted)
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("expected /simulate/partition not to block but it took %v", elapsed)
+	}
+
+	expectStatus(t, get("/"), http.StatusOK)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected request to block during the partition but it took only %v", elapsed)
+	}
+}
+
+func TestSimulatePartitionInvalid(t *testing.T) {
+	expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/partition?durationMs=200", nil)), http.StatusNotFound)
+
+	defer setFlag(t, "enableChaos", "true")()
+	expectStatus(t, get("/simulate/partition?durationMs=200"), http.StatusMethodNotAllowed)
+	expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/partition", nil)), http.StatusBadRequest)
+}
+
+func TestWarmup(t *testing.T) {
+	defer setFlag(t, "warmupRequests", "2")()
+	served := atomic.SwapInt64(&servedRequests, 0)
+	defer atomic.StoreInt64(&servedRequests, served)
+
+	for i := 1; i <= 2; i++ {
+		rec := get("/")
+		expectStatus(t, rec, http.StatusOK)
+		var body map[string]interface{}
+		decodeJSON(t, rec, &body)
+		if body["warming"] != true {
+			t.Errorf("request #%d: expected warming true but got %v", i, body["warming"])
+		}
+		if _, ok := body["request"]; ok {
+			t.Errorf("request #%d: expected reduced response but got %v", i, body)
+		}
+		if runtime, ok := body["runtime"].(map[string]interface{}); !ok || len(runtime) != 2 {
+			t.Errorf("request #%d: expected only runtime.branch and runtime.revision but got %v", i, body["runtime"])
+		}
+	}
+
+	var body responseBody
+	decodeJSON(t, get("/"), &body)
+	if body.Warming == nil || *body.Warming {
+		t.Errorf("expected warming false after warmup but got %v", body.Warming)
+	}
+	if body.Request.Method != "GET" {
+		t.Errorf("expected full response after warmup but got %+v", body)
+	}
+}
+
+func TestCustomStatusMessage(t *testing.T) {
+	defer setFlag(t, "allowCustomStatusMessage", "true")()
+	defer setFlag(t, "enableAdmin", "true")()
+	oldRequests := requests
+	requests = newRequestLog(10)
+	defer func() {
+		requests = oldRequests
+	}()
+	ts := newTestServer()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "GET /?statusCode=201&statusMessage=Custom+Message HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	statusLine, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusLine != "HTTP/1.1 201 Custom Message\r\n" {
+		t.Errorf("expected status line HTTP/1.1 201 Custom Message but got %q", statusLine)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request log is written after the hijacked connection was closed.
+	deadline := time.Now().Add(time.Second)
+	for len(requests.entries()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var entries []requestLogEntry
+	decodeJSON(t, get("/logs/requests"), &entries)
+	if len(entries) == 0 || entries[len(entries)-1].Status != http.StatusCreated {
+		t.Errorf("expected request logged with status 201 but got %+v", entries)
+	}
+}
+
+func TestCustomStatusMessageNotEnabled(t *testing.T) {
+	expectStatus(t, get("/?statusCode=201&statusMessage=Custom+Message"), http.StatusBadRequest)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	start := time.Now()
+	rec := get("/?delay=100ms&timeout=50ms")
+	expectStatus(t, rec, http.StatusGatewayTimeout)
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("expected handler to give up after 50ms but it took %v", elapsed)
+	}
+	var body errorBody
+	decodeJSON(t, rec, &body)
+	if body.Code != "handler_timeout" {
+		t.Errorf("expected code handler_timeout but got %q", body.Code)
+	}
+
+	expectStatus(t, get("/?delay=10ms&timeout=1s"), http.StatusOK)
+	expectStatus(t, get("/?timeout=foo"), http.StatusBadRequest)
+}
+
+func TestCanary(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer("")
+	ts.Start()
+	defer ts.Close()
+	canaryTS := httptest.NewUnstartedServer(nil)
+	canaryTS.Config = newServer("")
+	canaryServer = canaryTS.Config
+	defer func() {
+		canaryServer = nil
+	}()
+	canaryTS.Start()
+	defer canaryTS.Close()
+
+	for _, c := range []struct {
+		url      string
+		isCanary bool
+	}{{ts.URL, false}, {canaryTS.URL, true}} {
+		resp, err := http.Get(c.url + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body responseBody
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.Runtime.IsCanary != c.isCanary {
+			t.Errorf("%s: expected isCanary %v but got %v", c.url, c.isCanary, body.Runtime.IsCanary)
+		}
+	}
+}
+
+// setEnv sets the environment variable and returns a function which restores
+// its previous state.
+func setEnv(t *testing.T, name, value string) func() {
+	t.Helper()
+	old, existed := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if existed {
+			_ = os.Setenv(name, old)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	}
+}
+
+func TestIncludeEnv(t *testing.T) {
+	defer setFlag(t, "allowEnvEcho", "true")()
+	defer setEnv(t, "APP_TEST_VAR", "hello")()
+	defer setEnv(t, "APP_TEST_SECRET", "s3cr3t")()
+
+	rec := get("/?includeEnv=APP_")
+	expectStatus(t, rec, http.StatusOK)
+	var body responseBody
+	decodeJSON(t, rec, &body)
+	if body.EnvVars["APP_TEST_VAR"] != "hello" {
+		t.Errorf("expected APP_TEST_VAR=hello but got %v", body.EnvVars)
+	}
+	if body.EnvVars["APP_TEST_SECRET"] != "******" {
+		t.Errorf("expected APP_TEST_SECRET to be masked but got %v", body.EnvVars)
+	}
+	for name := range body.EnvVars {
+		if !strings.HasPrefix(name, "APP_") {
+			t.Errorf("expected only variables with prefix APP_ but got %s", name)
+		}
+	}
+}
+
+func TestIncludeEnvNotEnabled(t *testing.T) {
+	expectStatus(t, get("/?includeEnv=APP_"), http.StatusForbidden)
+}
+
+func TestHealthVerbose(t *testing.T) {
+	for _, c := range []struct {
+		ready      bool
+		statusCode int
+	}{{true, http.StatusOK}, {false, http.StatusServiceUnavailable}} {
+		restore := setReadyState(c.ready)
+		rec := get("/healthz/verbose")
+		restore()
+
+		if rec.Code != c.statusCode {
+			t.Errorf("ready=%v: expected status %d but got %d", c.ready, c.statusCode, rec.Code)
+		}
+		var body map[string]json.RawMessage
+		decodeJSON(t, rec, &body)
+		var health healthBody
+		if err := json.Unmarshal(body["health"], &health); err != nil || health.Ready != c.ready {
+			t.Errorf("ready=%v: expected health section with ready=%v but got %s", c.ready, c.ready, body["health"])
+		}
+		var stats statsBody
+		if err := json.Unmarshal(body["stats"], &stats); err != nil || body["stats"] == nil {
+			t.Errorf("ready=%v: expected stats section but got %s", c.ready, rec.Body.String())
+		}
+	}
+}
+
+func TestLargeBody(t *testing.T) {
+	defer setFlag(t, "enableLargeBody", "true")()
+
+	rec := get("/?body=large&mb=1")
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Body.Len() < 1024*1024 {
+		t.Errorf("expected at least %d bytes but got %d", 1024*1024, rec.Body.Len())
+	}
+	if contentLength := rec.Header().Get("Content-Length"); contentLength != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("expected Content-Length %d but got %q", rec.Body.Len(), contentLength)
+	}
+	var body responseBody
+	decodeJSON(t, rec, &body)
+	if body.Padding == "" {
+		t.Error("expected padding")
+	}
+
+	for _, mb := range []string{"", "0", "-1", "foo", "11"} {
+		expectStatus(t, get("/?body=large&mb="+mb), http.StatusBadRequest)
+	}
+}
+
+func TestLargeBodyNotEnabled(t *testing.T) {
+	expectStatus(t, get("/?body=large&mb=1"), http.StatusBadRequest)
+}
+
+func TestDecompression(t *testing.T) {
+	for encoding, newWriter := range map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+	} {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		if _, err := io.WriteString(w, `{"a":1}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		req := mergePatchRequest("/", buf.String())
+		req.Header.Set("Content-Encoding", encoding)
+		rec := serve(req)
+		expectStatus(t, rec, http.StatusOK)
+		var body struct {
+			PatchResult map[string]interface{} `json:"patchResult"`
+			Request     requestBody            `json:"request"`
+		}
+		decodeJSON(t, rec, &body)
+		if body.PatchResult["a"] != 1.0 {
+			t.Errorf("%s: expected patchResult a: 1 but got %v", encoding, body.PatchResult)
+		}
+		if _, ok := body.Request.Headers["Content-Encoding"]; ok {
+			t.Errorf("%s: expected Content-Encoding to be removed but got %v", encoding, body.Request.Headers)
+		}
+	}
+}
+
+func TestDecompressionFailure(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(w, `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	truncated := buf.String()[:buf.Len()-4]
+
+	for _, c := range []struct {
+		encoding string
+		body     string
+	}{{"gzip", `{"a":1}`}, {"gzip", truncated}, {"deflate", `{"a":1}`}} {
+		req := mergePatchRequest("/", c.body)
+		req.Header.Set("Content-Encoding", c.encoding)
+		if rec := serve(req); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %q: expected status 400 but got %d", c.encoding, c.body, rec.Code)
+		}
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	defer setFlag(t, "enableAdmin", "true")()
+	oldRequests := requests
+	requests = newRequestLog(10)
+	defer func() {
+		requests = oldRequests
+	}()
+
+	for i := 0; i < 5; i++ {
+		get("/?i=" + strconv.Itoa(i))
+	}
+	expectStatus(t, get("/not-found-here?statusCode=404"), http.StatusNotFound)
+
+	rec := get("/logs/requests")
+	expectStatus(t, rec, http.StatusOK)
+	var entries []requestLogEntry
+	decodeJSON(t, rec, &entries)
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 entries but got %d: %+v", len(entries), entries)
+	}
+	if entries[0].Path != "/not-found-here" || entries[0].Status != http.StatusNotFound {
+		t.Errorf("expected newest entry first but got %+v", entries[0])
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Method != "GET" || entries[i].Path != "/" || entries[i].Status != http.StatusOK {
+			t.Errorf("expected entry of GET / with status 200 but got %+v", entries[i])
+		}
+		if entries[i].Timestamp.After(entries[i-1].Timestamp) {
+			t.Errorf("expected reverse-chronological order but got %+v", entries)
+		}
+	}
+}
+
+func TestRequestLogNotEnabled(t *testing.T) {
+	expectStatus(t, get("/logs/requests"), http.StatusNotFound)
+}
+
+func tokenRequest(form url.Values) *http.Request {
+	req := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestOAuth2Token(t *testing.T) {
+	defer setFlag(t, "enableOAuth2Mock", "true")()
+
+	rec := serve(tokenRequest(url.Values{"grant_type": {"client_credentials"}}))
+	expectStatus(t, rec, http.StatusOK)
+	var body oauth2TokenBody
+	decodeJSON(t, rec, &body)
+	if !strings.HasPrefix(body.AccessToken, "mock-token-") || body.TokenType != "Bearer" || body.ExpiresIn != 3600 {
+		t.Errorf("expected mock Bearer token expiring in 3600s but got %+v", body)
+	}
+	if cacheControl := rec.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("expected Cache-Control no-store but got %q", cacheControl)
+	}
+
+	var other oauth2TokenBody
+	decodeJSON(t, serve(tokenRequest(url.Values{"grant_type": {"client_credentials"}})), &other)
+	if other.AccessToken == body.AccessToken {
+		t.Errorf("expected random tokens but got %s twice", body.AccessToken)
+	}
+}
+
+func TestOAuth2TokenFailures(t *testing.T) {
+	defer setFlag(t, "enableOAuth2Mock", "true")()
+
+	for _, c := range []struct {
+		req        *http.Request
+		statusCode int
+		error      string
+	}{
+		{tokenRequest(url.Values{"grant_type": {"password"}}), http.StatusBadRequest, "unsupported_grant_type"},
+		{tokenRequest(url.Values{}), http.StatusBadRequest, "unsupported_grant_type"},
+		{httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(`{"grant_type":"client_credentials"}`)), http.StatusBadRequest, "invalid_request"},
+	} {
+		rec := serve(c.req)
+		var body oauth2ErrorBody
+		decodeJSON(t, rec, &body)
+		if rec.Code != c.statusCode || body.Error != c.error {
+			t.Errorf("expected %d %s but got %d %s", c.statusCode, c.error, rec.Code, body.Error)
+		}
+	}
+	expectStatus(t, get("/oauth2/token"), http.StatusMethodNotAllowed)
+
+	defer setFlag(t, "oauth2FailProbability", "1")()
+	rec := serve(tokenRequest(url.Values{"grant_type": {"client_credentials"}}))
+	expectStatus(t, rec, http.StatusInternalServerError)
+	var body oauth2ErrorBody
+	decodeJSON(t, rec, &body)
+	if body.Error != "server_error" {
+		t.Errorf("expected error server_error but got %q", body.Error)
+	}
+}
+
+func TestOAuth2TokenNotEnabled(t *testing.T) {
+	expectStatus(t, serve(tokenRequest(url.Values{"grant_type": {"client_credentials"}})), http.StatusNotFound)
+}
+
+// purgeCDN empties the simulated CDN cache.
+func purgeCDN() {
+	cdnCacheMutex.Lock()
+	cdnCache = make(map[cdnCacheKey]cdnCacheEntry)
+	cdnCacheMutex.Unlock()
+}
+
+func expectCacheStatus(t *testing.T, rec *httptest.ResponseRecorder, expected string) {
+	t.Helper()
+	if status := rec.Header().Get("X-Cache-Status"); status != expected {
+		t.Errorf("expected X-Cache-Status %s but got %q", expected, status)
+	}
+}
+
+func TestCDN(t *testing.T) {
+	defer setFlag(t, "simulateCDN", "true")()
+	defer setFlag(t, "enableAdmin", "true")()
+	purgeCDN()
+	defer purgeCDN()
+
+	miss := get("/cdn?n=1")
+	expectStatus(t, miss, http.StatusOK)
+	expectCacheStatus(t, miss, "MISS")
+	if cacheControl := miss.Header().Get("Cache-Control"); cacheControl != "max-age=60" {
+		t.Errorf("expected Cache-Control max-age=60 but got %q", cacheControl)
+	}
+
+	// The cache is keyed by path only; the hit still reports the first query.
+	hit := get("/cdn?n=2")
+	expectStatus(t, hit, http.StatusOK)
+	expectCacheStatus(t, hit, "HIT")
+	if hit.Body.String() != miss.Body.String() {
+		t.Errorf("expected cached body %q but got %q", miss.Body.String(), hit.Body.String())
+	}
+
+	expectStatus(t, serve(httptest.NewRequest("POST", "/cdn/purge", nil)), http.StatusNoContent)
+	expectCacheStatus(t, get("/cdn?n=3"), "MISS")
+}
+
+func TestCDNDoesNotCacheCookies(t *testing.T) {
+	defer setFlag(t, "simulateCDN", "true")()
+	defer setFlag(t, "stickySession", "true")()
+	purgeCDN()
+	defer purgeCDN()
+
+	first := get("/cdn")
+	expectCacheStatus(t, first, "MISS")
+	second := get("/cdn")
+	expectCacheStatus(t, second, "MISS")
+	if second.Header().Get("Set-Cookie") == first.Header().Get("Set-Cookie") {
+		t.Errorf("expected a new session cookie but got %q twice", first.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestCDNDoesNotCacheWarmup(t *testing.T) {
+	defer setFlag(t, "simulateCDN", "true")()
+	defer setFlag(t, "warmupRequests", "1")()
+	served := atomic.SwapInt64(&servedRequests, 0)
+	defer atomic.StoreInt64(&servedRequests, served)
+	purgeCDN()
+	defer purgeCDN()
+
+	expectCacheStatus(t, get("/cdn"), "MISS")
+	rec := get("/cdn")
+	expectCacheStatus(t, rec, "MISS")
+	var body responseBody
+	decodeJSON(t, rec, &body)
+	if body.Warming == nil || *body.Warming {
+		t.Errorf("expected full response after warmup but got %s", rec.Body.String())
+	}
+}
+
+func TestCDNPurgeNotEnabled(t *testing.T) {
+	expectStatus(t, serve(httptest.NewRequest("POST", "/cdn/purge", nil)), http.StatusNotFound)
+}
+
+func TestJSONP(t *testing.T) {
+	defer setFlag(t, "enableJSONP", "true")()
+
+	rec := get("/?callback=my_func1")
+	expectStatus(t, rec, http.StatusOK)
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/javascript" {
+		t.Errorf("expected Content-Type application/javascript but got %q", contentType)
+	}
+	plain := strings.TrimSuffix(rec.Body.String(), "\n")
+	if !strings.HasPrefix(plain, "my_func1(") || !strings.HasSuffix(plain, ");") {
+		t.Fatalf("expected response wrapped in my_func1(...); but got %q", plain)
+	}
+	var body responseBody
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(strings.TrimPrefix(plain, "my_func1("), ");")), &body); err != nil {
+		t.Errorf("expected JSON inside the callback but got %q: %v", plain, err)
+	}
+
+	for _, callback := range []string{"1func", "my-func", "alert(1)", "a.b"} {
+		expectStatus(t, get("/?callback="+url.QueryEscape(callback)), http.StatusBadRequest)
+	}
+	expectStatus(t, get("/?callback=my_func1&format=yaml"), http.StatusBadRequest)
+}
+
+func TestJSONPNotEnabled(t *testing.T) {
+	expectStatus(t, get("/?callback=my_func1"), http.StatusBadRequest)
+}
+
+// watchHealth subscribes to /healthz/watch and returns the received events
+// and a function which ends the subscription.
+func watchHealth(t *testing.T, ts *httptest.Server) (<-chan healthBody, func()) {
+	t.Helper()
+	req, err := http.NewRequest("GET", ts.URL+"/healthz/watch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+	}
+	events := make(chan healthBody, 10)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				var event healthBody
+				if err := json.Unmarshal([]byte(data), &event); err == nil {
+					events <- event
+				}
+			}
+		}
+	}()
+	return events, func() {
+		resp.Body.Close()
+	}
+}
+
+func expectHealthEvent(t *testing.T, events <-chan healthBody, ready bool, within time.Duration) {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Ready != ready {
+			t.Errorf("expected event with ready=%v but got %+v", ready, event)
+		}
+	case <-time.After(within):
+		t.Errorf("expected event with ready=%v within %v", ready, within)
+	}
+}
+
+func TestHealthWatch(t *testing.T) {
+	defer setReadyState(false)()
+	ts := newTestServer()
+	defer ts.Close()
+	events, stop := watchHealth(t, ts)
+	defer stop()
+
+	expectHealthEvent(t, events, false, time.Second)
+	setReady(true)
+	expectHealthEvent(t, events, true, 200*time.Millisecond)
+	setReady(false)
+	expectHealthEvent(t, events, false, 200*time.Millisecond)
+}
+
+func TestHealthWatchDoesNotBlockPartition(t *testing.T) {
+	defer setFlag(t, "enableChaos", "true")()
+	ts := newTestServer()
+	defer ts.Close()
+	_, stop := watchHealth(t, ts)
+	defer stop()
+
+	start := time.Now()
+	expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/partition?durationMs=50", nil)), http.StatusAccepted)
+	expectStatus(t, get("/"), http.StatusOK)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected partition to end after 50ms but it took %v", elapsed)
+	}
+}
+
+func TestHealthWatchNotAcceptable(t *testing.T) {
+	expectStatus(t, get("/healthz/watch"), http.StatusNotAcceptable)
+}
+
+func TestNotifyHealthWatcherKeepsLatestState(t *testing.T) {
+	changes := make(chan bool, 1)
+	notifyHealthWatcher(changes, true)
+	notifyHealthWatcher(changes, false)
+	if v := <-changes; v {
+		t.Error("expected latest state false but got true")
+	}
+	select {
+	case v := <-changes:
+		t.Errorf("expected no further state but got %v", v)
+	default:
+	}
+}
+
+func TestSimulateSlowRead(t *testing.T) {
+	defer setFlag(t, "enableChaos", "true")()
+
+	rec := serve(httptest.NewRequest("POST", "/simulate/slow-read?byteDelayMs=1", strings.NewReader(strings.Repeat("x", 100))))
+	expectStatus(t, rec, http.StatusOK)
+	var body slowReadBody
+	decodeJSON(t, rec, &body)
+	if body.BytesRead != 100 {
+		t.Errorf("expected bytesRead 100 but got %d", body.BytesRead)
+	}
+	if body.DurationMs < 100 {
+		t.Errorf("expected at least 1ms per byte but took %dms", body.DurationMs)
+	}
+
+	defer setFlag(t, "maxBodySize", "50")()
+	decodeJSON(t, serve(httptest.NewRequest("POST", "/simulate/slow-read?byteDelayMs=0", strings.NewReader(strings.Repeat("x", 100)))), &body)
+	if body.BytesRead != 50 {
+		t.Errorf("expected bytesRead capped at 50 but got %d", body.BytesRead)
+	}
+}
+
+func TestSimulateSlowReadInvalid(t *testing.T) {
+	expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/slow-read", strings.NewReader("x"))), http.StatusNotFound)
+
+	defer setFlag(t, "enableChaos", "true")()
+	expectStatus(t, get("/simulate/slow-read"), http.StatusMethodNotAllowed)
+	expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/slow-read?byteDelayMs=foo", strings.NewReader("x"))), http.StatusBadRequest)
+}
+
+func TestWaitForServerToListen(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" {
+			t.Errorf("expected self-test of /healthz but got %s", req.URL.Path)
+		}
+		// A server which is not ready yet is up nevertheless.
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			resp.WriteHeader(http.StatusBadGateway)
+		} else {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	waitForServerToListen(ts.Listener.Addr().String())
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("expected 3 attempts but got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed < 2*selfTestInterval || elapsed > selfTestAttempts*selfTestInterval {
+		t.Errorf("expected self-test to retry twice but it took %v", elapsed)
+	}
+}
+
+func TestWaitForServerToListenGivesUp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	start := time.Now()
+	waitForServerToListen(addr)
+	if elapsed := time.Since(start); elapsed < selfTestAttempts*selfTestInterval {
+		t.Errorf("expected %d attempts but self-test ended after %v", selfTestAttempts, elapsed)
+	}
+}
+
+func TestIncludeStack(t *testing.T) {
+	defer setFlag(t, "enableDebug", "true")()
+
+	var body responseBody
+	decodeJSON(t, get("/?includeStack=true"), &body)
+	if !strings.HasPrefix(body.GoroutineStack, "goroutine ") || !strings.Contains(body.GoroutineStack, "handleEveryThingElse") {
+		t.Errorf("expected stack of the handling goroutine but got %q", body.GoroutineStack)
+	}
+
+	var withoutStack responseBody
+	decodeJSON(t, get("/"), &withoutStack)
+	if withoutStack.GoroutineStack != "" {
+		t.Errorf("expected no stack without ?includeStack=true but got %q", withoutStack.GoroutineStack)
+	}
+}
+
+func TestIncludeStackNotEnabled(t *testing.T) {
+	expectStatus(t, get("/?includeStack=true"), http.StatusBadRequest)
+}
+
+func TestHSTS(t *testing.T) {
+	defer setFlag(t, "hstsMaxAge", "24h")()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	if hsts := serve(req).Header().Get("Strict-Transport-Security"); hsts != "max-age=86400" {
+		t.Errorf("expected Strict-Transport-Security max-age=86400 but got %q", hsts)
+	}
+
+	defer setFlag(t, "hstsIncludeSubdomains", "true")()
+	defer setFlag(t, "hstsPreload", "true")()
+	if hsts := serve(req).Header().Get("Strict-Transport-Security"); hsts != "max-age=86400; includeSubDomains; preload" {
+		t.Errorf("expected Strict-Transport-Security with all directives but got %q", hsts)
+	}
+
+	if hsts := get("/").Header().Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("expected no Strict-Transport-Security without TLS but got %q", hsts)
+	}
+}
+
+func TestHSTSDisabledByDefault(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	if hsts := serve(req).Header().Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("expected no Strict-Transport-Security but got %q", hsts)
+	}
+}
+
+func isCompactJSON(t *testing.T, rec *httptest.ResponseRecorder) bool {
+	t.Helper()
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, rec.Body.Bytes()); err != nil {
+		t.Fatalf("cannot compact response %q: %v", rec.Body.String(), err)
+	}
+	return strings.TrimSuffix(rec.Body.String(), "\n") == compacted.String()
+}
+
+func TestJSONCompact(t *testing.T) {
+	rec := get("/?json=compact")
+	expectStatus(t, rec, http.StatusOK)
+	if !isCompactJSON(t, rec) {
+		t.Errorf("expected compact JSON but got %q", rec.Body.String())
+	}
+	if isCompactJSON(t, get("/")) {
+		t.Error("expected indented JSON by default")
+	}
+	expectStatus(t, get("/?json=foo"), http.StatusBadRequest)
+}
+
+func TestJSONPretty(t *testing.T) {
+	defer setFlag(t, "jsonIndent", "false")()
+
+	if !isCompactJSON(t, get("/")) {
+		t.Error("expected compact JSON with -jsonIndent=false")
+	}
+	rec := get("/?json=pretty")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), "\n  \"runtime\": {") {
+		t.Errorf("expected indented JSON but got %q", rec.Body.String())
+	}
+}
+
+func TestSimulateCPULimit(t *testing.T) {
+	defer setFlag(t, "enableChaos", "true")()
+
+	rec := serve(httptest.NewRequest("POST", "/simulate/cpu-limit?cpuPercent=10", nil))
+	expectStatus(t, rec, http.StatusAccepted)
+	var body cpuLimitBody
+	decodeJSON(t, rec, &body)
+	if body.CPUPercent != 10 {
+		t.Errorf("expected cpuPercent 10 but got %d", body.CPUPercent)
+	}
+
+	// Within the throttled part of the window requests have to wait for the
+	// next one.
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	expectStatus(t, get("/"), http.StatusOK)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected throttled request but it took only %v", elapsed)
+	}
+
+	expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/cpu-limit/stop", nil)), http.StatusNoContent)
+	cpuThrottleMutex.Lock()
+	throttle := currentCPUThrottle
+	cpuThrottleMutex.Unlock()
+	if throttle != nil {
+		t.Errorf("expected CPU limit to be removed but got %+v", throttle)
+	}
+}
+
+func TestSimulateCPULimitInvalid(t *testing.T) {
+	expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/cpu-limit?cpuPercent=10", nil)), http.StatusNotFound)
+
+	defer setFlag(t, "enableChaos", "true")()
+	for _, percent := range []string{"", "0", "101", "foo"} {
+		expectStatus(t, serve(httptest.NewRequest("POST", "/simulate/cpu-limit?cpuPercent="+percent, nil)), http.StatusBadRequest)
+	}
+	expectStatus(t, get("/simulate/cpu-limit?cpuPercent=10"), http.StatusMethodNotAllowed)
+}
+
+func TestCPUThrottleRemainingThrottling(t *testing.T) {
+	start := time.Now()
+	throttle := &cpuThrottle{percent: 30, start: start}
+	for _, c := range []struct {
+		offset   time.Duration
+		expected time.Duration
+	}{
+		{0, 0},
+		{29 * time.Millisecond, 0},
+		{30 * time.Millisecond, 70 * time.Millisecond},
+		{99 * time.Millisecond, time.Millisecond},
+		{100 * time.Millisecond, 0},
+		{250 * time.Millisecond, 50 * time.Millisecond},
+	} {
+		if actual := throttle.remainingThrottling(start.Add(c.offset)); actual != c.expected {
+			t.Errorf("offset %v: expected %v but got %v", c.offset, c.expected, actual)
+		}
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	rec := get("/?responseHeaders=3")
+	expectStatus(t, rec, http.StatusOK)
+	count, total := 0, 0
+	for name, values := range rec.Header() {
+		if !strings.HasPrefix(name, syntheticHeaderPrefix) {
+			continue
+		}
+		count++
+		if len(values) != 1 || len(values[0]) != 256 {
+			t.Errorf("expected one value of 256 bytes for %s but got %q", name, values)
+		}
+		total += len(name) + len(values[0])
+	}
+	if count != 3 {
+		t.Errorf("expected 3 synthetic headers but got %d", count)
+	}
+	var body responseBody
+	decodeJSON(t, rec, &body)
+	if body.TotalHeaderBytes != total {
+		t.Errorf("expected totalHeaderBytes %d but got %d", total, body.TotalHeaderBytes)
+	}
+}
+
+func TestResponseHeadersExceedingMaxSize(t *testing.T) {
+	expectStatus(t, get("/?responseHeaders=28"), http.StatusOK)
+	expectStatus(t, get("/?responseHeaders=29"), http.StatusBadRequest)
+	expectStatus(t, get("/?responseHeaders=-1"), http.StatusBadRequest)
+
+	start := time.Now()
+	expectStatus(t, get("/?responseHeaders="+strconv.Itoa(math.MaxInt32)), http.StatusBadRequest)
+	expectStatus(t, get("/?responseHeaders=9223372036854775807"), http.StatusBadRequest)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected huge responseHeaders to be rejected immediately but it took %v", elapsed)
+	}
+
+	defer setFlag(t, "maxSyntheticHeadersSize", "1024")()
+	expectStatus(t, get("/?responseHeaders=4"), http.StatusBadRequest)
+}
+
+func TestDNSService(t *testing.T) {
+	defer setFlag(t, "enableDNSSimulation", "true")()
+
+	rec := get("/dns/service?name=localhost")
+	expectStatus(t, rec, http.StatusOK)
+	var body dnsLookupBody
+	decodeJSON(t, rec, &body)
+	if body.Hostname != "localhost" {
+		t.Errorf("expected hostname localhost but got %q", body.Hostname)
+	}
+	loopback := false
+	for _, addr := range body.Addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.IsLoopback() {
+			loopback = true
+		}
+	}
+	if !loopback {
+		t.Errorf("expected loopback address for localhost but got %v", body.Addrs)
+	}
+
+	expectStatus(t, get("/dns/service"), http.StatusBadRequest)
+	expectStatus(t, serve(httptest.NewRequest("POST", "/dns/service?name=localhost", nil)), http.StatusMethodNotAllowed)
+}
+
+func TestDNSSelf(t *testing.T) {
+	defer setFlag(t, "enableDNSSimulation", "true")()
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := get("/dns/self")
+	if rec.Code == http.StatusBadGateway {
+		t.Skipf("own hostname %s cannot be resolved in this environment", hostname)
+	}
+	expectStatus(t, rec, http.StatusOK)
+	var body dnsLookupBody
+	decodeJSON(t, rec, &body)
+	if body.Hostname != hostname || len(body.Addrs) == 0 {
+		t.Errorf("expected addresses of %s but got %+v", hostname, body)
+	}
+}
+
+func TestDNSNotEnabled(t *testing.T) {
+	expectStatus(t, get("/dns/self"), http.StatusNotFound)
+	expectStatus(t, get("/dns/service?name=localhost"), http.StatusNotFound)
+}
+
+func expectErrorBody(t *testing.T, req *http.Request, rec *httptest.ResponseRecorder, statusCode int, code string) {
+	t.Helper()
+	target := req.Method + " " + req.URL.String()
+	if rec.Code != statusCode {
+		t.Errorf("%s: expected status %d but got %d", target, statusCode, rec.Code)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("%s: expected Content-Type application/json but got %q", target, contentType)
+	}
+	var body errorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Errorf("%s: expected JSON but got %q: %v", target, rec.Body.String(), err)
+		return
+	}
+	if body.Code != code || body.Message == "" || body.RequestID != "test-request" || body.Timestamp.IsZero() {
+		t.Errorf("%s: expected error %s with message, requestId and timestamp but got %+v", target, code, body)
+	}
+}
+
+func TestErrorsAreJSON(t *testing.T) {
+	defer setFlag(t, "maxBodySize", "10")()
+	defer setFlag(t, "enableChaos", "true")()
+
+	for _, c := range []struct {
+		req        *http.Request
+		statusCode int
+		code       string
+	}{
+		{httptest.NewRequest("GET", "/?format=xml", nil), http.StatusBadRequest, "bad_request"},
+		{httptest.NewRequest("GET", "/?statusMessage=Foo", nil), http.StatusBadRequest, "not_enabled"},
+		{httptest.NewRequest("GET", "/?includeEnv=APP_", nil), http.StatusForbidden, "not_enabled"},
+		{httptest.NewRequest("GET", "/logs/requests", nil), http.StatusNotFound, "not_enabled"},
+		{httptest.NewRequest("DELETE", "/healthz", nil), http.StatusMethodNotAllowed, "method_not_allowed"},
+		{httptest.NewRequest("GET", "/healthz/watch", nil), http.StatusNotAcceptable, "not_acceptable"},
+		{httptest.NewRequest("PUT", "/patch/base", strings.NewReader(`{"a":"0123456789"}`)), http.StatusRequestEntityTooLarge, "body_too_large"},
+		{httptest.NewRequest("POST", "/simulate/partition", nil), http.StatusBadRequest, "bad_request"},
+		{httptest.NewRequest("GET", "/?delay=100ms&timeout=10ms", nil), http.StatusGatewayTimeout, "handler_timeout"},
+	} {
+		c.req.Header.Set("X-Request-Id", "test-request")
+		rec := serve(c.req)
+		expectErrorBody(t, c.req, rec, c.statusCode, c.code)
+	}
+}
+
+func TestRecoveredPanicIsJSON(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "test-request")
+	rec := httptest.NewRecorder()
+	withRecovery(func(http.ResponseWriter, *http.Request) {
+		panic("expected test panic")
+	})(rec, req)
+	expectErrorBody(t, req, rec, http.StatusInternalServerError, "internal_error")
+}
+
+func TestLatencyTrackerPercentile(t *testing.T) {
+	tracker := newLatencyTracker(1000)
+	if p := tracker.Percentile(99); p != 0 {
+		t.Errorf("expected 0 without recorded durations but got %v", p)
+	}
+	for _, i := range mathrand.Perm(100) {
+		tracker.Record(time.Duration(i+1) * time.Millisecond)
+	}
+	for _, c := range []struct {
+		p        float64
+		expected time.Duration
+	}{{0, time.Millisecond}, {50, 50 * time.Millisecond}, {95, 95 * time.Millisecond}, {99, 99 * time.Millisecond}, {100, 100 * time.Millisecond}} {
+		if actual := tracker.Percentile(c.p); actual != c.expected {
+			t.Errorf("expected p%v %v but got %v", c.p, c.expected, actual)
+		}
+	}
+}
+
+func TestLatencyTrackerKeepsLatestDurations(t *testing.T) {
+	tracker := newLatencyTracker(3)
+	for i := 1; i <= 5; i++ {
+		tracker.Record(time.Duration(i) * time.Millisecond)
+	}
+	if p := tracker.Percentile(0); p != 3*time.Millisecond {
+		t.Errorf("expected oldest kept duration 3ms but got %v", p)
+	}
+	if p := tracker.Percentile(100); p != 5*time.Millisecond {
+		t.Errorf("expected latest duration 5ms but got %v", p)
+	}
+}
+
+func TestStatsLatency(t *testing.T) {
+	oldLatencies := latencies
+	latencies = newLatencyTracker(100)
+	defer func() {
+		latencies = oldLatencies
+	}()
+	for i := 1; i <= 100; i++ {
+		latencies.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	var stats statsBody
+	decodeJSON(t, get("/stats"), &stats)
+	if stats.Latency.P50Ms != 50 || stats.Latency.P95Ms != 95 || stats.Latency.P99Ms != 99 {
+		t.Errorf("expected p50Ms 50, p95Ms 95 and p99Ms 99 but got %+v", stats.Latency)
+	}
+}
+
+// BenchmarkLatencyTrackerRecord has to stay well below 1µs/op, because Record
+// is called for every request and should sustain 1M calls per second.
+func BenchmarkLatencyTrackerRecord(b *testing.B) {
+	tracker := newLatencyTracker(10000)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		d := time.Millisecond
+		for pb.Next() {
+			tracker.Record(d)
+			d++
+		}
+	})
+}
+
+func TestContentDisposition(t *testing.T) {
+	defer setFlag(t, "allowContentDisposition", "true")()
+
+	for target, expected := range map[string]string{
+		"/?contentDisposition=attachment":                        `attachment; filename="response.json"`,
+		"/?contentDisposition=attachment&filename=my-file_1.txt": `attachment; filename="my-file_1.txt"`,
+	} {
+		rec := get(target)
+		expectStatus(t, rec, http.StatusOK)
+		if contentDisposition := rec.Header().Get("Content-Disposition"); contentDisposition != expected {
+			t.Errorf("%s: expected Content-Disposition %s but got %q", target, expected, contentDisposition)
+		}
+	}
+	if contentDisposition := get("/").Header().Get("Content-Disposition"); contentDisposition != "" {
+		t.Errorf("expected no Content-Disposition but got %q", contentDisposition)
+	}
+
+	for _, filename := range []string{`a"b`, "../etc/passwd", "a b", "a;b"} {
+		expectStatus(t, get("/?contentDisposition=attachment&filename="+url.QueryEscape(filename)), http.StatusBadRequest)
+	}
+	expectStatus(t, get("/?contentDisposition=inline"), http.StatusBadRequest)
+}
+
+func TestContentDispositionNotEnabled(t *testing.T) {
+	expectStatus(t, get("/?contentDisposition=attachment"), http.StatusBadRequest)
+}
+
+func TestInjectLatency(t *testing.T) {
+	defer setFlag(t, "enableChaos", "true")()
+	oldLatencies := latencies
+	latencies = newLatencyTracker(100)
+	defer func() {
+		latencies = oldLatencies
+	}()
+	for i := 0; i < 90; i++ {
+		latencies.Record(10 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		latencies.Record(30 * time.Millisecond)
+	}
+
+	for source, expected := range map[string]time.Duration{
+		"p50": 10 * time.Millisecond,
+		"p95": 30 * time.Millisecond,
+		"p99": 30 * time.Millisecond,
+	} {
+		start := time.Now()
+		rec := get("/?inject=latency&source=" + source)
+		elapsed := time.Since(start)
+		expectStatus(t, rec, http.StatusOK)
+		var body responseBody
+		decodeJSON(t, rec, &body)
+		if body.InjectedLatencyMs != int(expected/time.Millisecond) {
+			t.Errorf("%s: expected injectedLatencyMs %d but got %d", source, expected/time.Millisecond, body.InjectedLatencyMs)
+		}
+		if elapsed < expected {
+			t.Errorf("%s: expected delay of at least %v but took %v", source, expected, elapsed)
+		}
+	}
+}
+
+func TestInjectLatencyInvalid(t *testing.T) {
+	expectStatus(t, get("/?inject=latency"), http.StatusBadRequest)
+
+	defer setFlag(t, "enableChaos", "true")()
+	expectStatus(t, get("/?inject=latency&source=p42"), http.StatusBadRequest)
+	expectStatus(t, get("/?inject=foo"), http.StatusBadRequest)
+}
+
+func TestConnectionHeader(t *testing.T) {
+	for _, c := range []struct {
+		mode   string
+		reused bool
+	}{{"keep-alive", true}, {"close", false}, {"", true}} {
+		restore := setFlag(t, "connectionHeader", c.mode)
+		ts := httptest.NewUnstartedServer(nil)
+		ts.Config = newServer("")
+		ts.Start()
+		client := &http.Client{Transport: &http.Transport{}}
+
+		var reused bool
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", ts.URL+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					reused = info.Reused
+				},
+			}))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			// The client removes Connection: close from the header and reports it as Close.
+			if c.mode == "close" {
+				if !resp.Close {
+					t.Errorf("%q: expected Connection close", c.mode)
+				}
+			} else if connection := resp.Header.Get("Connection"); connection != c.mode || resp.Close {
+				t.Errorf("%q: expected Connection %q but got %q (close=%v)", c.mode, c.mode, connection, resp.Close)
+			}
+		}
+		if reused != c.reused {
+			t.Errorf("%q: expected reused connection %v but got %v", c.mode, c.reused, reused)
+		}
+
+		client.Transport.(*http.Transport).CloseIdleConnections()
+		ts.Close()
+		restore()
+	}
+}
+
+func TestXFrameOptions(t *testing.T) {
+	if xFrameOptions := get("/").Header().Get("X-Frame-Options"); xFrameOptions != "" {
+		t.Errorf("expected no X-Frame-Options but got %q", xFrameOptions)
+	}
+
+	defer setFlag(t, "xFrameOptions", "DENY")()
+	if xFrameOptions := get("/").Header().Get("X-Frame-Options"); xFrameOptions != "DENY" {
+		t.Errorf("expected X-Frame-Options DENY but got %q", xFrameOptions)
+	}
+}
+
+// newProxyProtocolServer starts a server which expects a PROXY protocol header
+// on every connection and returns its address.
+func newProxyProtocolServer(t *testing.T) (string, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer("")
+	go func() {
+		_ = s.Serve(&proxyProtocolListener{l})
+	}()
+	return l.Addr().String(), func() {
+		_ = s.Close()
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	oldRequests := requests
+	requests = newRequestLog(10)
+	defer func() {
+		requests = oldRequests
+	}()
+	addr, stop := newProxyProtocolServer(t)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 80\r\nGET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body responseBody
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Request.RemoteIP != "203.0.113.7" {
+		t.Errorf("expected remoteIP 203.0.113.7 but got %q", body.Request.RemoteIP)
+	}
+	if entries := requests.entries(); len(entries) != 1 || entries[0].RemoteIP != "203.0.113.7" {
+		t.Errorf("expected request logged with remoteIP 203.0.113.7 but got %+v", entries)
+	}
+}
+
+func TestProxyProtocolWithoutHeader(t *testing.T) {
+	addr, stop := newProxyProtocolServer(t)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	// The server either closes the connection or answers it with 400.
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected connection without PROXY header to be rejected but got status %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestProxyProtocolSelfTest(t *testing.T) {
+	defer setFlag(t, "proxyProtocol", "true")()
+	addr, stop := newProxyProtocolServer(t)
+	defer stop()
+
+	start := time.Now()
+	waitForServerToListen(addr)
+	if elapsed := time.Since(start); elapsed >= selfTestInterval {
+		t.Errorf("expected first self-test to succeed but it took %v", elapsed)
+	}
+}
+
+func TestParseProxyProtocolHeader(t *testing.T) {
+	for line, expected := range map[string]string{
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51234 80\r\n":   "203.0.113.7:51234",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 51234 80\r\n": "[2001:db8::1]:51234",
+		"PROXY UNKNOWN\r\n": "",
+		"PROXY UNKNOWN 203.0.113.7 192.0.2.1 51234 80\r\n": "",
+	} {
+		addr, err := parseProxyProtocolHeader(line)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", line, err)
+			continue
+		}
+		if actual := fmt.Sprint(addr); expected != "" && actual != expected || expected == "" && addr != nil {
+			t.Errorf("%q: expected %q but got %v", line, expected, addr)
+		}
+	}
+
+	for _, line := range []string{
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51234 80\n",
+		"GET / HTTP/1.1\r\n",
+		"PROXY UDP4 203.0.113.7 192.0.2.1 51234 80\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51234\r\n",
+		"PROXY TCP4 foo 192.0.2.1 51234 80\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 70000 80\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51234 foo\r\n",
+	} {
+		if _, err := parseProxyProtocolHeader(line); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
+
+func TestProxyProtocolHeaderOf(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	destination := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}
+	header := proxyProtocolHeaderOf(source, destination)
+	if header != "PROXY TCP4 203.0.113.7 192.0.2.1 51234 80\r\n" {
+		t.Errorf("unexpected header %q", header)
+	}
+	if addr, err := parseProxyProtocolHeader(header); err != nil || addr.String() != source.String() {
+		t.Errorf("expected header to be parsed as %v but got %v (%v)", source, addr, err)
+	}
+}
+
+func TestMock(t *testing.T) {
+	defer setFlag(t, "enableMock", "true")()
+	defer setFlag(t, "mockSchemasDir", "testdata/schemas")()
+
+	rec := get("/mock/user")
+	expectStatus(t, rec, http.StatusOK)
+	var body map[string]interface{}
+	decodeJSON(t, rec, &body)
+	if len(body) != 6 {
+		t.Errorf("expected the 6 properties of the schema but got %v", body)
+	}
+	if _, ok := body["name"].(string); !ok {
+		t.Errorf("expected string name but got %v", body["name"])
+	}
+	if age, ok := body["age"].(float64); !ok || age != float64(int(age)) {
+		t.Errorf("expected integer age but got %v", body["age"])
+	}
+	if _, ok := body["score"].(float64); !ok {
+		t.Errorf("expected number score but got %v", body["score"])
+	}
+	if _, ok := body["active"].(bool); !ok {
+		t.Errorf("expected boolean active but got %v", body["active"])
+	}
+	if tags, ok := body["tags"].([]interface{}); !ok {
+		t.Errorf("expected array tags but got %v", body["tags"])
+	} else {
+		for _, tag := range tags {
+			if _, ok := tag.(string); !ok {
+				t.Errorf("expected string tags but got %v", tags)
+			}
+		}
+	}
+	if address, ok := body["address"].(map[string]interface{}); !ok {
+		t.Errorf("expected object address but got %v", body["address"])
+	} else if _, ok := address["city"].(string); !ok || len(address) != 1 {
+		t.Errorf("expected address with string city but got %v", address)
+	}
+}
+
+func TestMockErrors(t *testing.T) {
+	expectStatus(t, get("/mock/user"), http.StatusNotFound)
+
+	defer setFlag(t, "enableMock", "true")()
+	defer setFlag(t, "mockSchemasDir", "testdata/schemas")()
+	rec := get("/mock/unknown")
+	expectStatus(t, rec, http.StatusNotFound)
+	var body errorBody
+	decodeJSON(t, rec, &body)
+	if body.Code != "schema_not_found" {
+		t.Errorf("expected code schema_not_found but got %q", body.Code)
+	}
+	expectStatus(t, get("/mock/..%2Fschemas%2Fuser"), http.StatusBadRequest)
+	expectStatus(t, get("/mock/broken"), http.StatusInternalServerError)
+}
+
+func TestDebugTrace(t *testing.T) {
+	defer setFlag(t, "enableDebug", "true")()
+	ts := httptest.NewServer(newTraceServer("").Handler)
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := http.Get(ts.URL + "/debug/trace?seconds=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", resp.StatusCode, body)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/octet-stream" {
+		t.Errorf("expected Content-Type application/octet-stream but got %q", contentType)
+	}
+	if len(body) == 0 {
+		t.Error("expected non-empty trace")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected trace of 1s but it took %v", elapsed)
+	}
+}
+
+func TestDebugTraceInvalid(t *testing.T) {
+	handler := newTraceServer("").Handler
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/trace?seconds=1", nil))
+	expectStatus(t, rec, http.StatusNotFound)
+
+	defer setFlag(t, "enableDebug", "true")()
+	for _, seconds := range []string{"0", "-1", "foo", "61", "9223372036854775807"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/trace?seconds="+seconds, nil))
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestTLSHandshakeDelay(t *testing.T) {
+	// newServer only needs to know that TLS is enabled; httptest provides the certificate.
+	defer setFlag(t, "tlsCert", "unused.pem")()
+	defer setFlag(t, "tlsKey", "unused.pem")()
+	defer setFlag(t, "tlsHandshakeDelay", "50ms")()
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer("")
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	handshakeMs, err := strconv.Atoi(resp.Header.Get("X-TLS-Handshake-Ms"))
+	if err != nil {
+		t.Fatalf("expected numeric X-TLS-Handshake-Ms but got %q", resp.Header.Get("X-TLS-Handshake-Ms"))
+	}
+	if handshakeMs < 50 {
+		t.Errorf("expected handshake of at least 50ms but got %dms", handshakeMs)
+	}
+}
+
+func TestTLSHandshakeDelayWithoutTLS(t *testing.T) {
+	defer setFlag(t, "tlsHandshakeDelay", "50ms")()
+	if handshakeMs := get("/").Header().Get("X-TLS-Handshake-Ms"); handshakeMs != "" {
+		t.Errorf("expected no X-TLS-Handshake-Ms without TLS but got %q", handshakeMs)
+	}
+}
+
+func TestMutateHeader(t *testing.T) {
+	defer setFlag(t, "allowMutation", "true")()
+
+	req := httptest.NewRequest("GET", "/?mutateHeader="+url.QueryEscape("authorization:Bearer old:Bearer new")+"&mutateHeader="+url.QueryEscape("X-Other:foo:bar"), nil)
+	req.Header.Set("Authorization", "Bearer old")
+	req.Header.Set("X-Untouched", "Bearer old")
+	rec := serve(req)
+	expectStatus(t, rec, http.StatusOK)
+	var body responseBody
+	decodeJSON(t, rec, &body)
+	if authorization := http.Header(body.Request.Headers).Get("Authorization"); authorization != "Bearer new" {
+		t.Errorf("expected mutated Authorization Bearer new but got %q", authorization)
+	}
+	if untouched := http.Header(body.Request.Headers).Get("X-Untouched"); untouched != "Bearer old" {
+		t.Errorf("expected X-Untouched to be echoed as it is but got %q", untouched)
+	}
+	if !reflect.DeepEqual(body.MutatedHeaders, []string{"Authorization"}) {
+		t.Errorf("expected mutatedHeaders [Authorization] but got %v", body.MutatedHeaders)
+	}
+	if authorization := req.Header.Get("Authorization"); authorization != "Bearer old" {
+		t.Errorf("expected request itself to stay untouched but got Authorization %q", authorization)
+	}
+}
+
+func TestMutateHeaderInvalid(t *testing.T) {
+	expectStatus(t, get("/?mutateHeader="+url.QueryEscape("Authorization:a:b")), http.StatusBadRequest)
+
+	defer setFlag(t, "allowMutation", "true")()
+	for _, spec := range []string{"Authorization", "Authorization:a", ":a:b"} {
+		expectStatus(t, get("/?mutateHeader="+url.QueryEscape(spec)), http.StatusBadRequest)
+	}
+}
+
+func TestWorkerPoolSaturated(t *testing.T) {
+	defer setFlag(t, "workerPool", "1")()
+	defer setFlag(t, "workerQueueTimeout", "50ms")()
+	workers = semaphore.NewWeighted(1)
+	defer func() {
+		workers = nil
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get("/?delay=300ms")
+	}()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&workersBusy) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var stats statsBody
+	decodeJSON(t, get("/stats"), &stats)
+	if stats.WorkerPoolSize != 1 || stats.WorkersBusy != 1 || stats.WorkersIdle != 0 {
+		t.Errorf("expected 1 busy and 0 idle workers but got %+v", stats)
+	}
+
+	start := time.Now()
+	rec := get("/")
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	var body errorBody
+	decodeJSON(t, rec, &body)
+	if body.Code != "workers_exhausted" {
+		t.Errorf("expected code workers_exhausted but got %q", body.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected request to wait 50ms for a worker but it took %v", elapsed)
+	}
+
+	<-done
+	expectStatus(t, get("/"), http.StatusOK)
+	decodeJSON(t, get("/stats"), &stats)
+	if stats.WorkersBusy != 0 || stats.WorkersIdle != 1 {
+		t.Errorf("expected 0 busy and 1 idle workers but got %+v", stats)
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	defer setFlag(t, "allowSetCookieParam", "true")()
+
+	rec := get("/?set-cookie=SessionID%3Dabc123&set-cookie=Theme%3Ddark")
+	expectStatus(t, rec, http.StatusOK)
+	values := map[string]string{}
+	for _, cookie := range rec.Result().Cookies() {
+		values[cookie.Name] = cookie.Value
+	}
+	if !reflect.DeepEqual(values, map[string]string{"SessionID": "abc123", "Theme": "dark"}) {
+		t.Errorf("expected cookies SessionID=abc123 and Theme=dark but got Set-Cookie %q", rec.Header()["Set-Cookie"])
+	}
+	var body responseBody
+	decodeJSON(t, rec, &body)
+	if !reflect.DeepEqual(body.CookiesSet, []string{"SessionID", "Theme"}) {
+		t.Errorf("expected cookiesSet [SessionID Theme] but got %v", body.CookiesSet)
+	}
+}
+
+func TestSetCookieInvalid(t *testing.T) {
+	expectStatus(t, get("/?set-cookie=Theme%3Ddark"), http.StatusBadRequest)
+
+	defer setFlag(t, "allowSetCookieParam", "true")()
+	for _, spec := range []string{"Theme", "=dark", "The me=dark", "Theme;=dark", "Theme=da;rk", `Theme="dark"`, "Theme=da rk"} {
+		expectStatus(t, get("/?set-cookie="+url.QueryEscape(spec)), http.StatusBadRequest)
+	}
+}
+
+// startServerToShutdown starts a server as main does and returns a function
+// which undoes everything a shutdown changed.
+func startServerToShutdown(t *testing.T) (*httptest.Server, func()) {
+	t.Helper()
+	restoreReady := setReadyState(true)
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer("")
+	ts.Start()
+	server = ts.Config
+	return ts, func() {
+		ts.Close()
+		server = nil
+		shuttingDown = make(chan struct{})
+		readyMutex.Lock()
+		terminating = false
+		readyMutex.Unlock()
+		restoreReady()
+	}
+}
+
+func TestKubernetesGracefulShutdown(t *testing.T) {
+	defer setFlag(t, "kubernetesGraceful", "true")()
+	defer setFlag(t, "endpointRemovalDelay", "200ms")()
+	ts, restore := startServerToShutdown(t)
+	defer restore()
+	drainedAt := make(chan time.Time, 1)
+	server.RegisterOnShutdown(func() {
+		drainedAt <- time.Now()
+	})
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shutdownGracefully(syscall.SIGTERM)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for ready.Load().(bool) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Until the delay is over the server still serves requests, but reports not ready.
+	resp, err := http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 before draining but got %d", resp.StatusCode)
+	}
+	if len(drainedAt) != 0 {
+		t.Error("expected ready state to change before draining begins")
+	}
+
+	<-done
+	select {
+	case at := <-drainedAt:
+		if elapsed := at.Sub(start); elapsed < 200*time.Millisecond {
+			t.Errorf("expected draining after -endpointRemovalDelay but it began after %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected server to be drained")
+	}
+	setReady(true)
+	if ready.Load().(bool) {
+		t.Error("expected no ready state after termination")
+	}
+}
+
+func TestKubernetesGracefulShutdownOnSIGINT(t *testing.T) {
+	defer setFlag(t, "kubernetesGraceful", "true")()
+	defer setFlag(t, "endpointRemovalDelay", "1s")()
+	_, restore := startServerToShutdown(t)
+	defer restore()
+
+	start := time.Now()
+	shutdownGracefully(syscall.SIGINT)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected SIGINT to shut down without delay but it took %v", elapsed)
+	}
+	select {
+	case <-shuttingDown:
+	default:
+		t.Error("expected servers to be shut down")
+	}
+}
+
+func TestCDNSeparatesCanary(t *testing.T) {
+	defer setFlag(t, "simulateCDN", "true")()
+	purgeCDN()
+	defer purgeCDN()
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer("")
+	ts.Start()
+	defer ts.Close()
+	canaryTS := httptest.NewUnstartedServer(nil)
+	canaryTS.Config = newServer("")
+	canaryServer = canaryTS.Config
+	defer func() {
+		canaryServer = nil
+	}()
+	canaryTS.Start()
+	defer canaryTS.Close()
+
+	for _, c := range []struct {
+		url         string
+		isCanary    bool
+		cacheStatus string
+	}{
+		{ts.URL, false, "MISS"},
+		{canaryTS.URL, true, "MISS"},
+		{ts.URL, false, "HIT"},
+		{canaryTS.URL, true, "HIT"},
+	} {
+		resp, err := http.Get(c.url + "/cdn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body responseBody
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cacheStatus := resp.Header.Get("X-Cache-Status"); cacheStatus != c.cacheStatus {
+			t.Errorf("%s: expected X-Cache-Status %s but got %q", c.url, c.cacheStatus, cacheStatus)
+		}
+		if body.Runtime.IsCanary != c.isCanary {
+			t.Errorf("%s: expected isCanary %v but got %v", c.url, c.isCanary, body.Runtime.IsCanary)
+		}
+	}
+}